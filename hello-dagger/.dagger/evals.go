@@ -4,6 +4,7 @@ import (
 	"context"
 	_ "embed"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime/debug"
@@ -18,6 +19,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type EvalRunner struct {
@@ -26,7 +28,15 @@ type EvalRunner struct {
 	SystemPrompt string
 	Goose        bool
 	DaggerCli    *dagger.File
-	LLMKey       *dagger.Secret
+	// LLMKey is the key Goose authenticates with: a proxy token when Proxy
+	// holds the provider keys, so that the container never sees them.
+	LLMKey *dagger.Secret
+	// Proxy is the URL of the LLM proxy (utils/proxy) that eval traffic goes
+	// through, if any, so that reports can link to the raw exchanges.
+	Proxy string
+	// McpTap is the mcptap binary (utils/mcptap), if any, logging the MCP
+	// traffic between Goose and Dagger to /tmp/debug.mcp.jsonl.
+	McpTap *dagger.File
 }
 
 func NewEvalRunner() *EvalRunner {
@@ -55,6 +65,40 @@ func (m *EvalRunner) WithGoose() *EvalRunner {
 	return m
 }
 
+func (m *EvalRunner) WithProxy(proxy string) *EvalRunner {
+	m.Proxy = strings.TrimSuffix(proxy, "/")
+	return m
+}
+
+func (m *EvalRunner) WithMcpTap(mcpTap *dagger.File) *EvalRunner {
+	m.McpTap = mcpTap
+	return m
+}
+
+// session names the proxy session grouping the LLM traffic of an eval.
+func (m *EvalRunner) session(eval string) string {
+	return fmt.Sprintf("%s-%s-attempt%d", eval, m.Model, m.Attempt)
+}
+
+// trafficURL links to the eval's exchanges in the proxy web UI, filtered by
+// session or trace. It is empty without a proxy.
+func (m *EvalRunner) trafficURL(filter, value string) string {
+	if m.Proxy == "" || value == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/_proxy/ui?%s=%s", m.Proxy, filter, url.QueryEscape(value))
+}
+
+// linkTraffic adds to the report a link to the eval's exchanges.
+func (m *EvalRunner) linkTraffic(report *EvalReport, filter, value string) {
+	if report == nil {
+		return
+	}
+	if report.Traffic = m.trafficURL(filter, value); report.Traffic != "" {
+		report.Report += fmt.Sprintf("\n### LLM Traffic\n\n%s\n", report.Traffic)
+	}
+}
+
 func (m *EvalRunner) llm(opts ...dagger.LLMOpts) *dagger.LLM {
 	opts = append(opts, dagger.LLMOpts{
 		Model: m.Model,
@@ -75,6 +119,8 @@ type EvalReport struct {
 	ToolsDoc     string
 	InputTokens  int
 	OutputTokens int
+	// Traffic links to the eval's exchanges in the proxy web UI.
+	Traffic string
 }
 
 type withLLMReportStep struct {
@@ -374,8 +420,8 @@ func sh(s string) []string {
 	return []string{"sh", "-c", s}
 }
 
-func (e *EvalRunner) gooseCtr(ctx context.Context, target *dagger.Directory) *dagger.Container {
-	return dag.Container().
+func (e *EvalRunner) gooseCtr(ctx context.Context, target *dagger.Directory, session string) *dagger.Container {
+	ctr := dag.Container().
 		From("debian").
 		WithExec(sh(`apt-get update && apt-get install -y --no-install-recommends curl ca-certificates bzip2 libxcb1; rm -rf /var/{cache/apt,lib/apt/lists}/*`)).
 		WithExec(sh(`curl -fsSL "https://github.com/block/goose/releases/download/v1.0.20/download_cli.sh" | GOOSE_BIN_DIR=/usr/local/bin CONFIGURE=false bash`)).
@@ -384,18 +430,37 @@ func (e *EvalRunner) gooseCtr(ctx context.Context, target *dagger.Directory) *da
 		WithMountedDirectory("/target", target).
 		WithMountedFile("/bin/dagger", e.DaggerCli).
 		WithSecretVariable("OPENAI_API_KEY", e.LLMKey)
+	if e.Proxy != "" {
+		// Goose cannot send extra headers, so the session is named in the
+		// base path instead
+		ctr = ctr.
+			WithEnvVariable("OPENAI_HOST", e.Proxy).
+			WithEnvVariable("OPENAI_BASE_PATH", "_session/"+url.PathEscape(session)+"/v1/chat/completions")
+	}
+	if e.McpTap != nil {
+		// mcp.sh runs the MCP server through it
+		ctr = ctr.
+			WithMountedFile("/usr/local/bin/mcptap", e.McpTap).
+			WithEnvVariable("MCPTAP_SESSION", session)
+	}
+	return ctr
 }
 
 func (e *EvalRunner) GooseTrivyScan(
 	ctx context.Context,
 	target *dagger.Directory,
 ) (*EvalReport, error) {
-	ctr := e.gooseCtr(ctx, target)
+	session := e.session("GooseTrivyScan")
+	ctr := e.gooseCtr(ctx, target, session)
 	ctr = ctr.WithWorkdir("/root").
 		WithNewFile("llm-history", `{"working_dir":"/root","description":"Initial greeting exchange","message_count":2,"total_tokens":687,"input_tokens":673,"output_tokens":14,"accumulated_total_tokens":1373,"accumulated_input_tokens":1346,"accumulated_output_tokens":27}`).
 		WithExec(sh("goose run -p llm-history -r -t hi"), dagger.ContainerWithExecOpts{ExperimentalPrivilegedNesting: true})
 	out, err := ctr.Stdout(ctx)
-	return nil, fmt.Errorf("debugging: %w\nout: %s\n", err, out)
+	err = fmt.Errorf("debugging: %w\nout: %s\n", err, out)
+	if traffic := e.trafficURL("session", session); traffic != "" {
+		err = fmt.Errorf("%w\ntraffic: %s\n", err, traffic)
+	}
+	return nil, err
 }
 
 func (e *EvalRunner) TrivyScan(
@@ -409,7 +474,7 @@ func (e *EvalRunner) TrivyScan(
 			}),
 		)
 
-	return withLLMReport(
+	report, err := withLLMReport(
 		ctx,
 		llm,
 		[]withLLMReportStep{
@@ -449,6 +514,16 @@ func (e *EvalRunner) TrivyScan(
 			// },
 		}...,
 	)
+	if err != nil {
+		return nil, err
+	}
+	// the engine's LLM client cannot be told about sessions, so its traffic
+	// is not tagged with the eval, model and attempt; it is only found by
+	// trace, provided the client propagates the trace context
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		e.linkTraffic(report, "trace", sc.TraceID().String())
+	}
+	return report, nil
 }
 
 /// Example evals -- keeping it just for reference
@@ -67,11 +67,21 @@ func (m *HelloDagger) RunEvals(
 	ctx context.Context,
 	// +defaultPath="/hello-dagger"
 	project *dagger.Directory,
+	// API key given to Goose; with a proxy holding the provider keys, a
+	// proxy token
 	// +optional
 	llmKey *dagger.Secret,
 	daggerCli *dagger.File,
 	// +optional
 	models []string,
+	// URL of the LLM proxy the evals' traffic goes through, to link reports
+	// to their raw exchanges
+	// +optional
+	proxy string,
+	// mcptap binary (utils/mcptap) built for linux, to log the MCP traffic
+	// between Goose and Dagger
+	// +optional
+	mcpTap *dagger.File,
 ) ([]*EvalReport, error) {
 	var reports []*EvalReport
 
@@ -89,6 +99,12 @@ func (m *HelloDagger) RunEvals(
 		ev := NewEvalRunner().WithModel(model).WithGoose()
 		ev.LLMKey = llmKey
 		ev.DaggerCli = daggerCli
+		if proxy != "" {
+			ev = ev.WithProxy(proxy)
+		}
+		if mcpTap != nil {
+			ev = ev.WithMcpTap(mcpTap)
+		}
 
 		// // Eval #1
 		// r1, err := ev.NPMAudit(ctx, project)
@@ -1,3 +1,9 @@
 #!/bin/sh
 
+# Log the MCP traffic as JSON lines with mcptap (utils/mcptap) when it is
+# available, or else tee the raw streams.
+if command -v mcptap >/dev/null 2>&1; then
+	OPENAI_API_KEY=toto exec mcptap -log /tmp/debug.mcp.jsonl -- dagger -m /target mcp --env-privileged
+fi
+
 tee /tmp/debug.stdin.log | OPENAI_API_KEY=toto dagger -m /target mcp --env-privileged 2>/tmp/debug.stderr.log | /usr/bin/tee /tmp/debug.stdout.log
@@ -0,0 +1,3 @@
+module mcptap
+
+go 1.24.2
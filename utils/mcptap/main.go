@@ -0,0 +1,144 @@
+// Command mcptap runs an MCP server over stdio and logs the JSON-RPC
+// messages it exchanges with its client, the way utils/proxy logs HTTP
+// traffic:
+//
+//	mcptap -log mcp.jsonl -- dagger mcp
+//
+// Messages are relayed unchanged, one per line, and logged as JSON lines
+// with their direction, time, and the method and latency of the request
+// that responses answer.
+//
+// "mcptap replay" sends the client side of such a log to a fresh server and
+// reports how its responses differ from the recorded ones:
+//
+//	mcptap replay mcp.jsonl -- dagger mcp
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+func main() {
+	log.SetPrefix("mcptap: ")
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := replayCommand(os.Args[2:]); err != nil {
+			switch {
+			case errors.Is(err, flag.ErrHelp):
+				os.Exit(2)
+			case errors.Is(err, errChanged):
+				os.Exit(1)
+			}
+			log.Fatal(err)
+		}
+		return
+	}
+	fs := flag.NewFlagSet("mcptap", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mcptap [flags] -- command [args...]")
+		fs.PrintDefaults()
+	}
+	logPath := fs.String("log", os.Getenv("MCPTAP_LOG"), "append the JSONL message log to this file instead of stderr (env MCPTAP_LOG)")
+	session := fs.String("session", os.Getenv("MCPTAP_SESSION"), "session recorded with every message, e.g. the eval being run (env MCPTAP_SESSION)")
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// stdout carries the protocol, so the log goes elsewhere
+	var out io.Writer = os.Stderr
+	if *logPath != "" && *logPath != "-" {
+		f, err := os.OpenFile(*logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Fatalf("open log: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	t := newTap(out, *session)
+
+	cmd := exec.Command(fs.Arg(0), fs.Args()[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	// the server decides how to handle signals, e.g. to finish a call
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	go func() {
+		if err := t.Relay(stdin, os.Stdin, clientToServer); err != nil {
+			log.Printf("relay to server: %v", err)
+		}
+		// the client is gone: let the server see the end of its input
+		stdin.Close()
+	}()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := t.Relay(os.Stdout, stdout, serverToClient); err != nil {
+			log.Printf("relay to client: %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		// with the default log on stderr, the records carry the output
+		var copy io.Writer = os.Stderr
+		if out == os.Stderr {
+			copy = io.Discard
+		}
+		if err := t.Stderr(copy, stderr); err != nil {
+			log.Printf("server stderr: %v", err)
+		}
+	}()
+	wg.Wait()
+
+	err = cmd.Wait()
+	if unanswered := t.Unanswered(); len(unanswered) > 0 {
+		log.Printf("%d requests never answered: %s", len(unanswered), strings.Join(unanswered, ", "))
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		// killed by a signal
+		if exit.ExitCode() < 0 {
+			os.Exit(1)
+		}
+		os.Exit(exit.ExitCode())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
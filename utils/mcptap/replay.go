@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errChanged is returned by replayCommand when the server did not answer
+// as recorded.
+var errChanged = errors.New("responses differ from the recording")
+
+// Diff is a difference between a recorded response and the replayed one,
+// at a JSON pointer within the message. Elements of arrays of named
+// objects, such as tools, are identified by name rather than index. A
+// missing side means the value was added or removed.
+type Diff struct {
+	Path     string          `json:"path"`
+	Recorded json.RawMessage `json:"recorded,omitempty"`
+	Replayed json.RawMessage `json:"replayed,omitempty"`
+}
+
+// ReplayResult compares the responses to one request.
+type ReplayResult struct {
+	Seq    int64           `json:"seq"`
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Tool   string          `json:"tool,omitempty"`
+	// Status is same, changed, unanswered when the server did not answer
+	// in time, or unrecorded when the recording has no response.
+	Status string  `json:"status"`
+	Diffs  []*Diff `json:"diffs,omitempty"`
+	// LatencyMS is the time the server took to answer the replay.
+	LatencyMS float64 `json:"latencyMs,omitempty"`
+}
+
+// ReplayReport is the outcome of a replay.
+type ReplayReport struct {
+	Recording string          `json:"recording"`
+	Server    string          `json:"server"`
+	Requests  int             `json:"requests"`
+	Same      int             `json:"same"`
+	Changed   int             `json:"changed"`
+	Results   []*ReplayResult `json:"results"`
+}
+
+// replayCommand implements "mcptap replay", which sends the client side of
+// a recorded session to a fresh server and compares its responses with
+// the recorded ones.
+func replayCommand(args []string) error {
+	fs := flag.NewFlagSet("mcptap replay", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mcptap replay [flags] recording.jsonl -- command [args...]")
+		fs.PrintDefaults()
+	}
+	session := fs.String("session", "", "replay only the messages of this session of the recording")
+	logPath := fs.String("log", "", "log the replayed session to this file, e.g. to make it the new recording")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	timeout := fs.Duration("timeout", 5*time.Minute, "how long to wait for each response")
+	ignore := listFlag{"/result/serverInfo/version"}
+	fs.Var(&ignore, "ignore", "JSON pointer of response fields not compared, in addition to /result/serverInfo/version (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	recording, command := fs.Arg(0), fs.Args()[1:]
+	if command[0] == "--" {
+		command = command[1:]
+	}
+	if len(command) == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	records, err := readRecords(recording, *session)
+	if err != nil {
+		return err
+	}
+	var out io.Writer = io.Discard
+	if *logPath != "" {
+		f, err := os.OpenFile(*logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("open log: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	r := &replayer{
+		tap:           newTap(out, *session),
+		timeout:       *timeout,
+		waiting:       map[string]chan *Record{},
+		clientAnswers: map[string][]json.RawMessage{},
+	}
+	report, err := r.Run(records, command, ignore)
+	if err != nil {
+		return err
+	}
+	report.Recording = recording
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err == nil && report.Changed > 0 {
+		err = errChanged
+	}
+	return err
+}
+
+// listFlag collects repeated string flags.
+type listFlag []string
+
+func (lf *listFlag) String() string { return strings.Join(*lf, ",") }
+
+func (lf *listFlag) Set(v string) error {
+	*lf = append(*lf, v)
+	return nil
+}
+
+// readRecords reads a message log, keeping the records of session if set,
+// in order.
+func readRecords(path, session string) ([]*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []*Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if session == "" || rec.Session == session {
+			records = append(records, &rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+	return records, nil
+}
+
+// replayer drives a server with recorded client messages.
+type replayer struct {
+	tap     *tap
+	timeout time.Duration
+
+	sendMu sync.Mutex
+	stdin  io.Writer
+
+	mu sync.Mutex
+	// waiting holds the requests waiting for a response, by ID.
+	waiting map[string]chan *Record
+	// clientAnswers are the recorded client responses to server requests,
+	// by method, served in order.
+	clientAnswers map[string][]json.RawMessage
+}
+
+// Run replays the client messages of records against a new server running
+// command, one request at a time.
+func (r *replayer) Run(records []*Record, command, ignore []string) (*ReplayReport, error) {
+	// recorded maps the sequence number of client requests to their
+	// response, the next one with the same ID, as IDs may be reused by
+	// the sessions of a log
+	recorded := map[int64]*Record{}
+	requests := map[string]int64{}
+	for _, rec := range records {
+		switch {
+		case rec.Direction == clientToServer && rec.Kind == "request":
+			requests[string(rec.ID)] = rec.Seq
+		case rec.Direction == serverToClient && (rec.Kind == "response" || rec.Kind == "error"):
+			if seq, ok := requests[string(rec.ID)]; ok {
+				delete(requests, string(rec.ID))
+				recorded[seq] = rec
+			}
+		case rec.Direction == clientToServer && (rec.Kind == "response" || rec.Kind == "error"):
+			r.clientAnswers[rec.Method] = append(r.clientAnswers[rec.Method], rec.Message)
+		}
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	r.stdin = stdin
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.read(stdout)
+	}()
+	// the server is stopped whether the replay succeeds or not: closing
+	// its input lets it exit, and it is killed if it does not
+	defer func() {
+		stdin.Close()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			cmd.Process.Kill()
+		}
+		cmd.Wait()
+	}()
+
+	report := &ReplayReport{Server: strings.Join(command, " ")}
+	for _, rec := range records {
+		if rec.Direction != clientToServer || (rec.Kind != "request" && rec.Kind != "notification") {
+			continue
+		}
+		var response chan *Record
+		if rec.Kind == "request" {
+			response = make(chan *Record, 1)
+			r.mu.Lock()
+			r.waiting[string(rec.ID)] = response
+			r.mu.Unlock()
+		}
+		start := time.Now()
+		if err := r.send(rec.Message); err != nil {
+			return nil, fmt.Errorf("send %s: %w", rec.Method, err)
+		}
+		if response == nil {
+			continue
+		}
+		result := &ReplayResult{Seq: rec.Seq, ID: rec.ID, Method: rec.Method, Tool: rec.Tool}
+		report.Requests++
+		report.Results = append(report.Results, result)
+		var replayed *Record
+		select {
+		case replayed = <-response:
+			result.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+		case <-time.After(r.timeout):
+		case <-done:
+		}
+		want := recorded[rec.Seq]
+		switch {
+		case want == nil:
+			result.Status = "unrecorded"
+		case replayed == nil:
+			result.Status = "unanswered"
+		default:
+			result.Diffs = diffMessages(want.Message, replayed.Message, ignore)
+			result.Status = "same"
+			if len(result.Diffs) > 0 {
+				result.Status = "changed"
+			}
+		}
+		if result.Status == "same" {
+			report.Same++
+		} else {
+			report.Changed++
+		}
+	}
+	return report, nil
+}
+
+// send writes a message to the server.
+func (r *replayer) send(msg json.RawMessage) error {
+	line := append(bytes.TrimSpace(msg), '\n')
+	r.sendMu.Lock()
+	defer r.sendMu.Unlock()
+	for _, rec := range r.tap.records(time.Now(), clientToServer, line) {
+		r.tap.write(rec)
+	}
+	_, err := r.stdin.Write(line)
+	return err
+}
+
+// read dispatches the messages of the server: responses to the replayed
+// requests, and requests of the server, answered as recorded.
+func (r *replayer) read(stdout io.Reader) {
+	br := bufio.NewReader(stdout)
+	for {
+		line, err := br.ReadBytes('\n')
+		for _, rec := range r.tap.records(time.Now(), serverToClient, line) {
+			r.tap.write(rec)
+			switch rec.Kind {
+			case "response", "error":
+				r.mu.Lock()
+				if ch := r.waiting[string(rec.ID)]; ch != nil {
+					delete(r.waiting, string(rec.ID))
+					ch <- rec
+				}
+				r.mu.Unlock()
+			case "request":
+				go r.answer(rec)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// answer responds to a request of the server with the next recorded
+// client response to the same method, or else an error.
+func (r *replayer) answer(req *Record) {
+	r.mu.Lock()
+	answers := r.clientAnswers[req.Method]
+	var answer map[string]any
+	if len(answers) > 0 {
+		json.Unmarshal(answers[0], &answer)
+		r.clientAnswers[req.Method] = answers[1:]
+	}
+	r.mu.Unlock()
+	if answer == nil {
+		answer = map[string]any{
+			"jsonrpc": "2.0",
+			"error":   map[string]any{"code": -32601, "message": "no recorded response to " + req.Method},
+		}
+	}
+	answer["id"] = req.ID
+	msg, _ := json.Marshal(answer)
+	r.send(msg)
+}
+
+// diffMessages compares two JSON-RPC messages, leaving out their ID and
+// the ignored paths.
+func diffMessages(recorded, replayed json.RawMessage, ignore []string) []*Diff {
+	a, b := decodeMessage(recorded), decodeMessage(replayed)
+	var diffs []*Diff
+	diffJSON("", a, b, &diffs)
+	kept := diffs[:0]
+	for _, d := range diffs {
+		if !ignored(d.Path, ignore) {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+func decodeMessage(raw json.RawMessage) any {
+	var m map[string]any
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	d.Decode(&m)
+	delete(m, "id")
+	delete(m, "jsonrpc")
+	return m
+}
+
+func ignored(path string, ignore []string) bool {
+	for _, prefix := range ignore {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// diffJSON appends the differences between a and b, found at path.
+func diffJSON(path string, a, b any, diffs *[]*Diff) {
+	if ma, ok := a.(map[string]any); ok {
+		if mb, ok := b.(map[string]any); ok {
+			keys := map[string]bool{}
+			for k := range ma {
+				keys[k] = true
+			}
+			for k := range mb {
+				keys[k] = true
+			}
+			for _, k := range sortedKeys(keys) {
+				va, inA := ma[k]
+				vb, inB := mb[k]
+				diffPresent(path+"/"+escapePointer(k), va, inA, vb, inB, diffs)
+			}
+			return
+		}
+	}
+	if la, ok := a.([]any); ok {
+		if lb, ok := b.([]any); ok {
+			na, nb := byName(la), byName(lb)
+			if na != nil && nb != nil {
+				diffJSON(path, na, nb, diffs)
+				return
+			}
+			for i := 0; i < max(len(la), len(lb)); i++ {
+				var va, vb any
+				if i < len(la) {
+					va = la[i]
+				}
+				if i < len(lb) {
+					vb = lb[i]
+				}
+				diffPresent(path+"/"+strconv.Itoa(i), va, i < len(la), vb, i < len(lb), diffs)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		*diffs = append(*diffs, &Diff{Path: path, Recorded: rawJSON(a), Replayed: rawJSON(b)})
+	}
+}
+
+func diffPresent(path string, a any, inA bool, b any, inB bool, diffs *[]*Diff) {
+	switch {
+	case inA && inB:
+		diffJSON(path, a, b, diffs)
+	case inA:
+		*diffs = append(*diffs, &Diff{Path: path, Recorded: rawJSON(a)})
+	case inB:
+		*diffs = append(*diffs, &Diff{Path: path, Replayed: rawJSON(b)})
+	}
+}
+
+// byName indexes a list of objects by their name, as for the tools of
+// tools/list, so that they are compared whatever their order. It returns
+// nil for other lists.
+func byName(list []any) map[string]any {
+	if len(list) == 0 {
+		return nil
+	}
+	m := map[string]any{}
+	for _, v := range list {
+		obj, _ := v.(map[string]any)
+		name, ok := obj["name"].(string)
+		if !ok {
+			return nil
+		}
+		if _, dup := m[name]; dup {
+			return nil
+		}
+		m[name] = v
+	}
+	return m
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+func rawJSON(v any) json.RawMessage {
+	if v == nil {
+		return json.RawMessage("null")
+	}
+	data, _ := json.Marshal(v)
+	return data
+}
+
+// WriteText prints the report for humans: a line per request, followed by
+// its differences.
+func (rep *ReplayReport) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, res := range rep.Results {
+		name := res.Method
+		if res.Tool != "" {
+			name += " " + res.Tool
+		}
+		fmt.Fprintf(bw, "%-60s %s\n", name, res.Status)
+		for _, d := range res.Diffs {
+			switch {
+			case d.Recorded == nil:
+				fmt.Fprintf(bw, "    %s: added %s\n", d.Path, ellipsis(d.Replayed))
+			case d.Replayed == nil:
+				fmt.Fprintf(bw, "    %s: removed %s\n", d.Path, ellipsis(d.Recorded))
+			default:
+				fmt.Fprintf(bw, "    %s: %s -> %s\n", d.Path, ellipsis(d.Recorded), ellipsis(d.Replayed))
+			}
+		}
+	}
+	fmt.Fprintf(bw, "%d requests: %d same, %d changed\n", rep.Requests, rep.Same, rep.Changed)
+	return bw.Flush()
+}
+
+// ellipsis shortens long values in the text report.
+func ellipsis(v json.RawMessage) string {
+	const limit = 80
+	if s := []rune(string(v)); len(s) > limit {
+		return string(s[:limit]) + "…"
+	}
+	return string(v)
+}
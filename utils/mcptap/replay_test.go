@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestDiffMessages(t *testing.T) {
+	for _, tt := range []struct {
+		name               string
+		recorded, replayed string
+		ignore             []string
+		// want holds the path, recorded and replayed values of each
+		// difference.
+		want [][3]string
+	}{
+		{
+			name:     "same but the ID",
+			recorded: `{"jsonrpc":"2.0","id":1,"result":{"tools":[]}}`,
+			replayed: `{"jsonrpc":"2.0","id":7,"result":{"tools":[]}}`,
+		},
+		{
+			name:     "reordered tools",
+			recorded: `{"result":{"tools":[{"name":"build","description":"Build"},{"name":"test"}]}}`,
+			replayed: `{"result":{"tools":[{"name":"test"},{"name":"build","description":"Build"}]}}`,
+		},
+		{
+			name:     "changed, added and removed tools",
+			recorded: `{"result":{"tools":[{"name":"build","description":"Build"},{"name":"lint"}]}}`,
+			replayed: `{"result":{"tools":[{"name":"test"},{"name":"build","description":"Build it"}]}}`,
+			want: [][3]string{
+				{"/result/tools/build/description", `"Build"`, `"Build it"`},
+				{"/result/tools/lint", `{"name":"lint"}`, ""},
+				{"/result/tools/test", "", `{"name":"test"}`},
+			},
+		},
+		{
+			name:     "added and removed fields",
+			recorded: `{"result":{"isError":false,"content":[]}}`,
+			replayed: `{"result":{"content":[],"structuredContent":{"ok":true}}}`,
+			want: [][3]string{
+				{"/result/isError", "false", ""},
+				{"/result/structuredContent", "", `{"ok":true}`},
+			},
+		},
+		{
+			name:     "unnamed lists by index",
+			recorded: `{"result":{"content":[{"type":"text","text":"a"}]}}`,
+			replayed: `{"result":{"content":[{"type":"text","text":"b"},{"type":"text","text":"c"}]}}`,
+			want: [][3]string{
+				{"/result/content/0/text", `"a"`, `"b"`},
+				{"/result/content/1", "", `{"text":"c","type":"text"}`},
+			},
+		},
+		{
+			name:     "duplicate names by index",
+			recorded: `{"result":{"prompts":[{"name":"a","v":1},{"name":"a","v":2}]}}`,
+			replayed: `{"result":{"prompts":[{"name":"a","v":2},{"name":"a","v":1}]}}`,
+			want: [][3]string{
+				{"/result/prompts/0/v", "1", "2"},
+				{"/result/prompts/1/v", "2", "1"},
+			},
+		},
+		{
+			name:     "type change",
+			recorded: `{"result":{"count":1}}`,
+			replayed: `{"result":{"count":"1"}}`,
+			want:     [][3]string{{"/result/count", "1", `"1"`}},
+		},
+		{
+			name:     "result to error",
+			recorded: `{"result":{}}`,
+			replayed: `{"error":{"code":-32601,"message":"no such method"}}`,
+			want: [][3]string{
+				{"/error", "", `{"code":-32601,"message":"no such method"}`},
+				{"/result", "{}", ""},
+			},
+		},
+		{
+			name:     "escaped keys",
+			recorded: `{"result":{"a/b":1,"c~d":1}}`,
+			replayed: `{"result":{"a/b":2,"c~d":2}}`,
+			want: [][3]string{
+				{"/result/a~1b", "1", "2"},
+				{"/result/c~0d", "1", "2"},
+			},
+		},
+		{
+			name:     "ignored",
+			recorded: `{"result":{"serverInfo":{"name":"dagger","version":"v0.18.1"},"content":[{"text":"a"}],"contentType":"text"}}`,
+			replayed: `{"result":{"serverInfo":{"name":"dagger","version":"v0.18.2"},"content":[{"text":"b"}],"contentType":"json"}}`,
+			ignore:   []string{"/result/serverInfo/version", "/result/content"},
+			// a prefix only ignores the fields below it
+			want: [][3]string{{"/result/contentType", `"text"`, `"json"`}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs := diffMessages(json.RawMessage(tt.recorded), json.RawMessage(tt.replayed), tt.ignore)
+			var got [][3]string
+			for _, d := range diffs {
+				got = append(got, [3]string{d.Path, string(d.Recorded), string(d.Replayed)})
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("diffs = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("diff %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReplayerRun(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run the server")
+	}
+	record := func(seq int64, direction, kind, method, msg string) *Record {
+		var m message
+		json.Unmarshal([]byte(msg), &m)
+		return &Record{Seq: seq, Direction: direction, Kind: kind, ID: m.ID, Method: method, Message: json.RawMessage(msg)}
+	}
+	records := []*Record{
+		record(1, clientToServer, "request", "initialize", `{"jsonrpc":"2.0","id":1,"method":"initialize"}`),
+		record(2, serverToClient, "response", "initialize", `{"jsonrpc":"2.0","id":1,"result":{"protocolVersion":"2025-03-26"}}`),
+		record(3, clientToServer, "notification", "notifications/initialized", `{"jsonrpc":"2.0","method":"notifications/initialized"}`),
+		record(4, clientToServer, "request", "tools/list", `{"jsonrpc":"2.0","id":2,"method":"tools/list"}`),
+		record(5, serverToClient, "response", "tools/list", `{"jsonrpc":"2.0","id":2,"result":{"tools":[{"name":"build"},{"name":"test"}]}}`),
+	}
+	// the server answers the two requests, with a new protocol version and
+	// its tools in another order, then exits once its input is closed
+	server := `read l; echo '{"jsonrpc":"2.0","id":1,"result":{"protocolVersion":"2025-06-18"}}'
+read l; read l; echo '{"jsonrpc":"2.0","id":2,"result":{"tools":[{"name":"test"},{"name":"build"}]}}'
+while read l; do :; done`
+	r := &replayer{
+		tap:           newTap(io.Discard, ""),
+		timeout:       5 * time.Second,
+		waiting:       map[string]chan *Record{},
+		clientAnswers: map[string][]json.RawMessage{},
+	}
+	report, err := r.Run(records, []string{"sh", "-c", server}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Requests != 2 || report.Same != 1 || report.Changed != 1 {
+		t.Fatalf("%d requests: %d same, %d changed, want 2: 1 same, 1 changed", report.Requests, report.Same, report.Changed)
+	}
+	initialize, tools := report.Results[0], report.Results[1]
+	if initialize.Status != "changed" || len(initialize.Diffs) != 1 || initialize.Diffs[0].Path != "/result/protocolVersion" {
+		t.Errorf("initialize: %s %+v, want a changed /result/protocolVersion", initialize.Status, initialize.Diffs)
+	}
+	if tools.Status != "same" {
+		t.Errorf("tools/list: %s %+v, want the same tools", tools.Status, tools.Diffs)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directions of the messages relayed by the tap.
+const (
+	clientToServer = "client->server"
+	serverToClient = "server->client"
+	// serverStderr is the diagnostic output of the server, one record per
+	// line, logged along with the messages to keep them in order.
+	serverStderr = "server-stderr"
+)
+
+// Record is one JSON-RPC message relayed by the tap, written to the log as
+// a single JSON line.
+type Record struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Session   string    `json:"session,omitempty"`
+	Direction string    `json:"direction"`
+	// Kind is request, notification, response or error for JSON-RPC
+	// messages, invalid for lines that are not, and stderr.
+	Kind string          `json:"kind"`
+	ID   json.RawMessage `json:"id,omitempty"`
+	// Method is the method of the request, or of the request answered by
+	// a response.
+	Method string `json:"method,omitempty"`
+	// Tool is the tool called by a tools/call request and its response.
+	Tool string `json:"tool,omitempty"`
+	// LatencyMS is the time between a request and its response.
+	LatencyMS float64 `json:"latencyMs,omitempty"`
+	// Bytes is the size of the line carrying the message.
+	Bytes int `json:"bytes"`
+	// Message is the JSON-RPC message; Text is the line when it is not
+	// JSON, or stderr output.
+	Message json.RawMessage `json:"message,omitempty"`
+	Text    string          `json:"text,omitempty"`
+}
+
+// message is the part of a JSON-RPC message the tap needs to understand.
+type message struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params struct {
+		Name string `json:"name"`
+	} `json:"params"`
+	Error json.RawMessage `json:"error"`
+}
+
+// pending is a request waiting for its response.
+type pending struct {
+	time   time.Time
+	method string
+	tool   string
+}
+
+// tap logs the messages exchanged by an MCP client and server, pairing
+// requests with their responses by ID.
+type tap struct {
+	session string
+
+	mu      sync.Mutex
+	enc     *json.Encoder
+	seq     int64
+	pending map[string]*pending
+}
+
+func newTap(w io.Writer, session string) *tap {
+	return &tap{session: session, enc: json.NewEncoder(w), pending: map[string]*pending{}}
+}
+
+// Relay copies the newline-delimited messages of src to dst unchanged,
+// logging each one before it is forwarded.
+func (t *tap) Relay(dst io.Writer, src io.Reader, direction string) error {
+	r := bufio.NewReader(src)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			// requests are registered and logged before they are
+			// forwarded, so that their response cannot come first
+			for _, rec := range t.records(time.Now(), direction, line) {
+				t.write(rec)
+			}
+			if _, werr := dst.Write(line); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Stderr logs each line of the stderr output of the server, and copies it
+// to w.
+func (t *tap) Stderr(w io.Writer, src io.Reader) error {
+	r := bufio.NewReader(src)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			w.Write(line)
+			t.write(&Record{
+				Time:      time.Now(),
+				Direction: serverStderr,
+				Kind:      "stderr",
+				Bytes:     len(line),
+				Text:      strings.TrimRight(string(line), "\r\n"),
+			})
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// records returns the records of a line sent in direction, pairing
+// responses with their requests: one per message for batches.
+func (t *tap) records(received time.Time, direction string, line []byte) []*Record {
+	data := bytes.TrimSpace(line)
+	if len(data) == 0 {
+		return nil
+	}
+	var records []*Record
+	var batch []json.RawMessage
+	if data[0] != '[' || json.Unmarshal(data, &batch) != nil {
+		batch = []json.RawMessage{data}
+	}
+	for _, raw := range batch {
+		rec := &Record{Time: received, Direction: direction, Bytes: len(line)}
+		var m message
+		if !json.Valid(raw) || json.Unmarshal(raw, &m) != nil {
+			rec.Kind = "invalid"
+			rec.Text = string(raw)
+			records = append(records, rec)
+			continue
+		}
+		rec.Message = raw
+		if m.ID != nil && string(m.ID) != "null" {
+			rec.ID = m.ID
+		}
+		t.mu.Lock()
+		switch {
+		case m.Method != "" && rec.ID != nil:
+			rec.Kind = "request"
+			rec.Method = m.Method
+			if m.Method == "tools/call" {
+				rec.Tool = m.Params.Name
+			}
+			t.pending[pendingKey(direction, rec.ID)] = &pending{time: received, method: rec.Method, tool: rec.Tool}
+		case m.Method != "":
+			rec.Kind = "notification"
+			rec.Method = m.Method
+		default:
+			rec.Kind = "response"
+			if m.Error != nil && string(m.Error) != "null" {
+				rec.Kind = "error"
+			}
+			// a response answers a request sent the other way
+			requester := serverToClient
+			if direction == serverToClient {
+				requester = clientToServer
+			}
+			key := pendingKey(requester, rec.ID)
+			if p := t.pending[key]; p != nil {
+				delete(t.pending, key)
+				rec.Method, rec.Tool = p.method, p.tool
+				rec.LatencyMS = float64(received.Sub(p.time).Microseconds()) / 1000
+			}
+		}
+		t.mu.Unlock()
+		records = append(records, rec)
+	}
+	return records
+}
+
+func pendingKey(direction string, id json.RawMessage) string {
+	return direction + " " + string(id)
+}
+
+func (t *tap) write(rec *Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	rec.Seq = t.seq
+	rec.Session = t.session
+	t.enc.Encode(rec)
+}
+
+// Unanswered returns the requests still waiting for a response, as
+// "direction id method".
+func (t *tap) Unanswered() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var list []string
+	for key, p := range t.pending {
+		list = append(list, key+" "+p.method)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writerFunc is an io.Writer standing in for the other end of the relay.
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// decodeRecords decodes the log of a tap.
+func decodeRecords(t *testing.T, log *bytes.Buffer) []*Record {
+	t.Helper()
+	var records []*Record
+	dec := json.NewDecoder(log)
+	for dec.More() {
+		rec := &Record{}
+		if err := dec.Decode(rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestTapRecords(t *testing.T) {
+	var log bytes.Buffer
+	tp := newTap(&log, "eval-1")
+	client := strings.Join([]string{
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+		`{"jsonrpc":"2.0","method":"notifications/initialized"}`,
+		`[{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"build"}},{"jsonrpc":"2.0","id":"a","method":"tools/list"}]`,
+		`{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"test"}}`,
+		`{"jsonrpc":"2.0","id":7,"result":{"roots":[]}}`,
+		`not json`,
+		"",
+	}, "\n")
+	server := strings.Join([]string{
+		`{"jsonrpc":"2.0","id":1,"result":{}}`,
+		`{"jsonrpc":"2.0","id":7,"method":"roots/list"}`,
+		`{"jsonrpc":"2.0","id":"a","result":{"tools":[]}}`,
+		`{"jsonrpc":"2.0","id":2,"error":{"code":-32603,"message":"failed"}}`,
+		`{"jsonrpc":"2.0","id":9,"result":{}}`,
+		"",
+	}, "\n")
+	var toServer, toClient bytes.Buffer
+	if err := tp.Relay(&toServer, strings.NewReader(client), clientToServer); err != nil {
+		t.Fatal(err)
+	}
+	// responses come later, with a measurable latency
+	time.Sleep(time.Millisecond)
+	if err := tp.Relay(&toClient, strings.NewReader(server), serverToClient); err != nil {
+		t.Fatal(err)
+	}
+	if toServer.String() != client || toClient.String() != server {
+		t.Errorf("messages not relayed unchanged:\n%s\n%s", &toServer, &toClient)
+	}
+
+	type summary struct {
+		seq             int64
+		direction, kind string
+		id              string
+		method, tool    string
+		latency         bool
+	}
+	var got []summary
+	for _, rec := range decodeRecords(t, &log) {
+		if rec.Session != "eval-1" {
+			t.Errorf("record %d: session %q, want eval-1", rec.Seq, rec.Session)
+		}
+		if rec.Kind == "invalid" && rec.Text != "not json" {
+			t.Errorf("invalid record text = %q", rec.Text)
+		}
+		got = append(got, summary{rec.Seq, rec.Direction, rec.Kind, string(rec.ID), rec.Method, rec.Tool, rec.LatencyMS > 0})
+	}
+	want := []summary{
+		{1, clientToServer, "request", "1", "initialize", "", false},
+		{2, clientToServer, "notification", "", "notifications/initialized", "", false},
+		// batches get a record per message
+		{3, clientToServer, "request", "2", "tools/call", "build", false},
+		{4, clientToServer, "request", `"a"`, "tools/list", "", false},
+		{5, clientToServer, "request", "3", "tools/call", "test", false},
+		// a response to a request the server has not sent yet
+		{6, clientToServer, "response", "7", "", "", false},
+		{7, clientToServer, "invalid", "", "", "", false},
+		{8, serverToClient, "response", "1", "initialize", "", true},
+		{9, serverToClient, "request", "7", "roots/list", "", false},
+		{10, serverToClient, "response", `"a"`, "tools/list", "", true},
+		{11, serverToClient, "error", "2", "tools/call", "build", true},
+		{12, serverToClient, "response", "9", "", "", false},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("records:\n%v\nwant\n%v", got, want)
+	}
+	unanswered := []string{
+		clientToServer + " 3 tools/call",
+		serverToClient + " 7 roots/list",
+	}
+	if got := tp.Unanswered(); !slices.Equal(got, unanswered) {
+		t.Errorf("unanswered = %q, want %q", got, unanswered)
+	}
+}
+
+func TestRelayLogsRequestsFirst(t *testing.T) {
+	var log bytes.Buffer
+	tp := newTap(&log, "")
+	// the server answers as soon as it gets the request, before Relay
+	// returns from forwarding it
+	server := writerFunc(func(p []byte) (int, error) {
+		response := `{"jsonrpc":"2.0","id":1,"result":{}}` + "\n"
+		if err := tp.Relay(io.Discard, strings.NewReader(response), serverToClient); err != nil {
+			t.Error(err)
+		}
+		return len(p), nil
+	})
+	if err := tp.Relay(server, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"ping"}`+"\n"), clientToServer); err != nil {
+		t.Fatal(err)
+	}
+	records := decodeRecords(t, &log)
+	if len(records) != 2 || records[0].Kind != "request" || records[0].Seq != 1 || records[1].Kind != "response" || records[1].Seq != 2 {
+		for _, rec := range records {
+			t.Logf("%d %s %s", rec.Seq, rec.Direction, rec.Kind)
+		}
+		t.Fatal("want the request logged first, then its response")
+	}
+	if records[1].Method != "ping" {
+		t.Errorf("response method = %q, want ping", records[1].Method)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Subset of the Anthropic messages wire format the proxy translates chat
+// completions to and from.
+
+// anthropicVersion is sent unless the client picks a version itself.
+const anthropicVersion = "2023-06-01"
+
+// anthropicMaxTokens is the max_tokens of requests that set none, which
+// Anthropic requires.
+const anthropicMaxTokens = 4096
+
+type anthropicMessages struct {
+	Model         string              `json:"model"`
+	MaxTokens     int                 `json:"max_tokens"`
+	System        string              `json:"system,omitempty"`
+	Messages      []*anthropicMessage `json:"messages"`
+	Tools         []*anthropicTool    `json:"tools,omitempty"`
+	ToolChoice    map[string]any      `json:"tool_choice,omitempty"`
+	Temperature   *float64            `json:"temperature,omitempty"`
+	TopP          *float64            `json:"top_p,omitempty"`
+	StopSequences []string            `json:"stop_sequences,omitempty"`
+	Stream        bool                `json:"stream,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string            `json:"role"`
+	Content []*anthropicBlock `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+	// tool_result
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+	// image
+	Source map[string]string `json:"source,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicUsage struct {
+	InputTokens              int64 `json:"input_tokens"`
+	OutputTokens             int64 `json:"output_tokens"`
+	CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+}
+
+// openAI returns the usage in the OpenAI format, whose prompt tokens
+// include the cached ones.
+func (u *anthropicUsage) openAI() json.RawMessage {
+	prompt := u.InputTokens + u.CacheReadInputTokens + u.CacheCreationInputTokens
+	return openAIUsage(prompt, u.OutputTokens, u.CacheReadInputTokens)
+}
+
+type anthropicResponse struct {
+	ID         string            `json:"id"`
+	Model      string            `json:"model"`
+	Content    []*anthropicBlock `json:"content"`
+	StopReason string            `json:"stop_reason"`
+	Usage      anthropicUsage    `json:"usage"`
+}
+
+// anthropicRequest translates a chat completion request into a messages
+// request. System messages become the system prompt, tool calls tool_use
+// blocks and tool messages tool_result blocks of a user message.
+func anthropicRequest(chat *chatRequest, key string) (*providerRequest, error) {
+	req := &anthropicMessages{
+		Model:         chat.Model,
+		MaxTokens:     max(chat.MaxTokens, chat.MaxCompletionTokens),
+		Temperature:   chat.Temperature,
+		TopP:          chat.TopP,
+		StopSequences: chat.StopSequences(),
+		Stream:        chat.Stream,
+	}
+	if req.MaxTokens == 0 {
+		req.MaxTokens = anthropicMaxTokens
+	}
+	if t := req.Temperature; t != nil && *t > 1 {
+		// OpenAI temperatures go up to 2, Anthropic ones up to 1
+		one := 1.0
+		req.Temperature = &one
+	}
+	var system []string
+	for _, m := range chat.Messages {
+		var blocks []*anthropicBlock
+		role := "user"
+		switch m.Role {
+		case "system", "developer":
+			system = append(system, m.Text())
+			continue
+		case "assistant":
+			role = "assistant"
+			if text := m.Text(); text != "" {
+				blocks = append(blocks, &anthropicBlock{Type: "text", Text: text})
+			}
+			for _, call := range m.ToolCalls {
+				blocks = append(blocks, &anthropicBlock{
+					Type:  "tool_use",
+					ID:    call.ID,
+					Name:  call.Function.Name,
+					Input: toolArguments(call),
+				})
+			}
+		case "tool":
+			blocks = append(blocks, &anthropicBlock{Type: "tool_result", ToolUseID: m.ToolCallID, Content: m.Text()})
+		default:
+			for _, p := range m.Parts() {
+				switch {
+				case p.Type == "text" && p.Text != "":
+					blocks = append(blocks, &anthropicBlock{Type: "text", Text: p.Text})
+				case p.Type == "image_url" && p.ImageURL != nil:
+					source := map[string]string{"type": "url", "url": p.ImageURL.URL}
+					if mediaType, data, ok := dataURL(p.ImageURL.URL); ok {
+						source = map[string]string{"type": "base64", "media_type": mediaType, "data": data}
+					}
+					blocks = append(blocks, &anthropicBlock{Type: "image", Source: source})
+				}
+			}
+		}
+		if len(blocks) == 0 {
+			// Anthropic rejects empty messages
+			continue
+		}
+		// Anthropic wants alternating roles, e.g. the results of parallel
+		// tool calls in a single user message
+		if n := len(req.Messages); n > 0 && req.Messages[n-1].Role == role {
+			req.Messages[n-1].Content = append(req.Messages[n-1].Content, blocks...)
+			continue
+		}
+		req.Messages = append(req.Messages, &anthropicMessage{Role: role, Content: blocks})
+	}
+	req.System = strings.Join(system, "\n\n")
+	for _, tool := range chat.Tools {
+		schema := tool.Function.Parameters
+		if len(schema) == 0 || string(schema) == "null" {
+			schema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		req.Tools = append(req.Tools, &anthropicTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: schema,
+		})
+	}
+	if len(req.Tools) > 0 {
+		switch mode, function := chat.ToolChoiceMode(); {
+		case function != "":
+			req.ToolChoice = map[string]any{"type": "tool", "name": function}
+		case mode == "required":
+			req.ToolChoice = map[string]any{"type": "any"}
+		case mode == "none":
+			req.ToolChoice = map[string]any{"type": "none"}
+		}
+	}
+	header := http.Header{"Anthropic-Version": {anthropicVersion}}
+	if key != "" {
+		header.Set("X-Api-Key", key)
+	}
+	return &providerRequest{path: "/v1/messages", header: header, body: req}, nil
+}
+
+// anthropicFinishReason maps a stop reason to a finish reason.
+func anthropicFinishReason(reason string) string {
+	switch reason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal":
+		return "content_filter"
+	}
+	return "stop"
+}
+
+// anthropicCompletion translates a messages response into a chat
+// completion.
+func anthropicCompletion(data []byte) (*chatCompletion, error) {
+	var resp anthropicResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	msg := &chatMessage{Role: "assistant"}
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			msg.Content += block.Text
+		case "tool_use":
+			msg.ToolCalls = append(msg.ToolCalls, &toolCall{
+				ID:       block.ID,
+				Type:     "function",
+				Function: toolFunction{Name: block.Name, Arguments: string(block.Input)},
+			})
+		}
+	}
+	finish := anthropicFinishReason(resp.StopReason)
+	return &chatCompletion{
+		ID:      resp.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   resp.Model,
+		Choices: []*chatChoice{{Message: msg, FinishReason: &finish}},
+		Usage:   resp.Usage.openAI(),
+	}, nil
+}
+
+// translateAnthropicStream translates the events of a streamed messages
+// response into chat completion chunks.
+func translateAnthropicStream(r io.Reader, c *chunkWriter) error {
+	var usage anthropicUsage
+	finish := "stop"
+	// tools maps the index of tool_use blocks to that of tool calls
+	tools := map[int]int{}
+	// args records the tool_use blocks whose input was streamed
+	args := map[int]bool{}
+	return readEvents(r, func(event, data string) error {
+		var e struct {
+			Type    string             `json:"type"`
+			Message *anthropicResponse `json:"message"`
+			Index   int                `json:"index"`
+			Block   *anthropicBlock    `json:"content_block"`
+			Delta   struct {
+				Type        string `json:"type"`
+				Text        string `json:"text"`
+				PartialJSON string `json:"partial_json"`
+				StopReason  string `json:"stop_reason"`
+			} `json:"delta"`
+			Usage *anthropicUsage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return fmt.Errorf("anthropic %s event: %w", event, err)
+		}
+		switch e.Type {
+		case "message_start":
+			if e.Message != nil {
+				c.id, c.model, usage = e.Message.ID, e.Message.Model, e.Message.Usage
+			}
+			return c.Delta(&chatMessage{Role: "assistant"})
+		case "content_block_start":
+			if e.Block == nil || e.Block.Type != "tool_use" {
+				return nil
+			}
+			i := len(tools)
+			tools[e.Index] = i
+			return c.Delta(&chatMessage{ToolCalls: []*toolCall{{
+				Index:    &i,
+				ID:       e.Block.ID,
+				Type:     "function",
+				Function: toolFunction{Name: e.Block.Name},
+			}}})
+		case "content_block_delta":
+			switch e.Delta.Type {
+			case "text_delta":
+				return c.Delta(&chatMessage{Content: e.Delta.Text})
+			case "input_json_delta":
+				if e.Delta.PartialJSON == "" {
+					return nil
+				}
+				i := tools[e.Index]
+				args[e.Index] = true
+				return c.Delta(&chatMessage{ToolCalls: []*toolCall{{
+					Index:    &i,
+					Function: toolFunction{Arguments: e.Delta.PartialJSON},
+				}}})
+			}
+		case "content_block_stop":
+			// tools without input get no input_json_delta, but arguments
+			// must still be a JSON object, as in non-streamed responses
+			i, ok := tools[e.Index]
+			if !ok || args[e.Index] {
+				return nil
+			}
+			return c.Delta(&chatMessage{ToolCalls: []*toolCall{{
+				Index:    &i,
+				Function: toolFunction{Arguments: "{}"},
+			}}})
+		case "message_delta":
+			if e.Delta.StopReason != "" {
+				finish = anthropicFinishReason(e.Delta.StopReason)
+			}
+			if e.Usage != nil {
+				// output tokens are cumulative
+				usage.OutputTokens = e.Usage.OutputTokens
+			}
+		case "message_stop":
+			return c.Finish(finish, usage.openAI())
+		case "error":
+			return c.Error([]byte(data))
+		}
+		return nil
+	})
+}
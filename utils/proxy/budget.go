@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Budget caps the traffic sent upstream. Zero means unlimited.
+type Budget struct {
+	Requests int64   `json:"requests"`
+	Tokens   int64   `json:"tokens"`
+	CostUSD  float64 `json:"costUsd"`
+}
+
+func (b Budget) unlimited() bool {
+	return b.Requests <= 0 && b.Tokens <= 0 && b.CostUSD <= 0
+}
+
+// BudgetConfig stops the traffic once a budget is spent: later requests are
+// rejected until the proxy restarts. Unlike rate limits, budgets never
+// refill.
+type BudgetConfig struct {
+	// Session applies to each session separately, Global to all the
+	// traffic.
+	Session Budget `json:"session"`
+	Global  Budget `json:"global"`
+}
+
+// parseBudgetFlag parses a budget such as usd=5,tokens=2000000,requests=500.
+func parseBudgetFlag(spec string) (Budget, error) {
+	var b Budget
+	for _, field := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return b, fmt.Errorf("budget %q: expected name=value, got %q", spec, field)
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return b, fmt.Errorf("budget %q: bad %s: %w", spec, name, err)
+		}
+		switch name {
+		case "usd":
+			b.CostUSD = v
+		case "tokens":
+			b.Tokens = int64(v)
+		case "requests":
+			b.Requests = int64(v)
+		default:
+			return b, fmt.Errorf("budget %q: unknown limit %q, expected usd, tokens or requests", spec, name)
+		}
+	}
+	return b, nil
+}
+
+// budgetError rejects a request once the budget of its scope is spent.
+type budgetError struct {
+	scope     string
+	reason    string
+	trippedBy string
+}
+
+func (e *budgetError) Error() string {
+	return fmt.Sprintf("proxy budget for %s exceeded%s: %s", e.scope, blame(e.scope, e.trippedBy), e.reason)
+}
+
+// blame names the session that exceeded the budget of scope, unless scope
+// is that session.
+func blame(scope, session string) string {
+	if session == "" || scope == fmt.Sprintf("session %q", session) {
+		return ""
+	}
+	return fmt.Sprintf(" by session %q", session)
+}
+
+// spend is what a scope has spent so far, and why it was stopped, if it
+// was.
+type spend struct {
+	Requests int64   `json:"requests"`
+	Tokens   int64   `json:"tokens"`
+	CostUSD  float64 `json:"costUsd"`
+	Exceeded string  `json:"exceeded,omitempty"`
+	// TrippedBy is the session whose request exceeded the budget.
+	TrippedBy string `json:"trippedBy,omitempty"`
+	// Rejected counts the requests refused since.
+	Rejected int64 `json:"rejected,omitempty"`
+}
+
+// trip stops the scope name when its spend reached a limit of b, blaming
+// session.
+func (s *spend) trip(name string, b Budget, session string) {
+	if s.Exceeded != "" {
+		return
+	}
+	switch {
+	case b.CostUSD > 0 && s.CostUSD >= b.CostUSD:
+		s.Exceeded = fmt.Sprintf("$%.4f of $%.4f spent", s.CostUSD, b.CostUSD)
+	case b.Tokens > 0 && s.Tokens >= b.Tokens:
+		s.Exceeded = fmt.Sprintf("%d of %d tokens used", s.Tokens, b.Tokens)
+	case b.Requests > 0 && s.Requests >= b.Requests:
+		s.Exceeded = fmt.Sprintf("%d of %d requests sent", s.Requests, b.Requests)
+	default:
+		return
+	}
+	s.TrippedBy = session
+	log.Printf("Budget for %s exceeded%s: %s; rejecting further requests", name, blame(name, session), s.Exceeded)
+}
+
+// budgets tracks the spend of the global and session scopes. Requests are
+// counted when they are sent, tokens and cost once they complete, so
+// requests already in flight may overshoot the token and cost limits.
+type budgets struct {
+	cfg BudgetConfig
+
+	mu       sync.Mutex
+	global   spend
+	sessions map[string]*spend
+}
+
+// newBudgets returns the budgets of cfg, or nil when nothing is limited.
+func newBudgets(cfg BudgetConfig) *budgets {
+	if cfg.Session.unlimited() && cfg.Global.unlimited() {
+		return nil
+	}
+	return &budgets{cfg: cfg, sessions: map[string]*spend{}}
+}
+
+// scopes returns the scopes a request of session is charged to, with their
+// names and budgets.
+func (b *budgets) scopes(session string) ([]*spend, []string, []Budget) {
+	spends := []*spend{&b.global}
+	names := []string{"all sessions"}
+	limits := []Budget{b.cfg.Global}
+	if session != "" && !b.cfg.Session.unlimited() {
+		s := b.sessions[session]
+		if s == nil {
+			s = &spend{}
+			b.sessions[session] = s
+		}
+		spends = append(spends, s)
+		names = append(names, fmt.Sprintf("session %q", session))
+		limits = append(limits, b.cfg.Session)
+	}
+	return spends, names, limits
+}
+
+// Check rejects a request of session when a budget it is charged to is
+// spent, without counting it, so that such requests do not queue for the
+// rate limiter first.
+func (b *budgets) Check(session string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	spends, names, _ := b.scopes(session)
+	return b.check(spends, names)
+}
+
+func (b *budgets) check(spends []*spend, names []string) error {
+	for i, s := range spends {
+		if s.Exceeded != "" {
+			s.Rejected++
+			return &budgetError{scope: names[i], reason: s.Exceeded, trippedBy: s.TrippedBy}
+		}
+	}
+	return nil
+}
+
+// Admit counts a request of session about to be sent upstream, unless a
+// budget it is charged to was spent in the meantime.
+func (b *budgets) Admit(session string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	spends, names, limits := b.scopes(session)
+	if err := b.check(spends, names); err != nil {
+		return err
+	}
+	for i, s := range spends {
+		s.Requests++
+		s.trip(names[i], limits[i], session)
+	}
+	return nil
+}
+
+// Charge adds the usage and cost of an admitted exchange.
+func (b *budgets) Charge(x *Exchange) {
+	if b == nil || x.Usage == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	spends, names, limits := b.scopes(x.Session)
+	for i, s := range spends {
+		s.Tokens += x.Usage.InputTokens + x.Usage.OutputTokens
+		s.CostUSD += x.CostUSD
+		s.trip(names[i], limits[i], x.Session)
+	}
+}
+
+// Snapshot returns the limits and spend of each scope for the stats
+// endpoint.
+func (b *budgets) Snapshot() map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sessions := make(map[string]spend, len(b.sessions))
+	for name, s := range b.sessions {
+		sessions[name] = *s
+	}
+	return map[string]any{
+		"limits":   b.cfg,
+		"global":   b.global,
+		"sessions": sessions,
+	}
+}
+
+// writeBudgetExceeded answers a request over budget the way OpenAI answers
+// once the quota of an account is used up.
+func writeBudgetExceeded(w http.ResponseWriter, err *budgetError) {
+	writeError(w, http.StatusTooManyRequests, "insufficient_quota", err.Error())
+}
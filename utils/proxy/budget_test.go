@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBudgets(t *testing.T) {
+	if newBudgets(BudgetConfig{}) != nil {
+		t.Error("budgets kept without limits")
+	}
+	b := newBudgets(BudgetConfig{
+		Session: Budget{Requests: 2},
+		Global:  Budget{Tokens: 100},
+	})
+	errorOf := func(err error) string {
+		if err == nil {
+			return ""
+		}
+		return err.Error()
+	}
+
+	// checking does not count a request, admitting does
+	for range 3 {
+		if err := b.Check("a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Admit("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Check("a"); err != nil {
+		t.Fatalf("one of two requests sent: %v", err)
+	}
+	// the last request allowed is admitted and stops the session
+	if err := b.Admit("a"); err != nil {
+		t.Fatal(err)
+	}
+	want := `proxy budget for session "a" exceeded: 2 of 2 requests sent`
+	if got := errorOf(b.Check("a")); got != want {
+		t.Errorf("session a: %q, want %q", got, want)
+	}
+	if got := errorOf(b.Admit("a")); got != want {
+		t.Errorf("session a: %q, want %q", got, want)
+	}
+	if err := b.Admit("b"); err != nil {
+		t.Errorf("session b: %v, want it unaffected by session a", err)
+	}
+
+	// the global budget names the session that spent it
+	b.Charge(&Exchange{Session: "b", Usage: &Usage{InputTokens: 60, OutputTokens: 40}})
+	want = `proxy budget for all sessions exceeded by session "b": 100 of 100 tokens used`
+	if got := errorOf(b.Check("c")); got != want {
+		t.Errorf("session c: %q, want %q", got, want)
+	}
+	if got := errorOf(b.Check("")); got != want {
+		t.Errorf("no session: %q, want %q", got, want)
+	}
+
+	snapshot := b.Snapshot()
+	global, sessions := snapshot["global"].(spend), snapshot["sessions"].(map[string]spend)
+	if global.Requests != 3 || global.Tokens != 100 || global.TrippedBy != "b" || global.Rejected != 2 {
+		t.Errorf("global spend = %+v", global)
+	}
+	if a := sessions["a"]; a.Requests != 2 || a.Rejected != 2 {
+		t.Errorf("session a spend = %+v", a)
+	}
+	if _, ok := sessions[""]; ok {
+		t.Error("requests without a session have a session budget")
+	}
+}
+
+func TestParseBudgetFlag(t *testing.T) {
+	for _, tt := range []struct {
+		spec string
+		want Budget
+		err  string
+	}{
+		{"usd=5,tokens=2000000,requests=500", Budget{Requests: 500, Tokens: 2000000, CostUSD: 5}, ""},
+		{" usd=0.25 ", Budget{CostUSD: 0.25}, ""},
+		{"tokens", Budget{}, "expected name=value"},
+		{"tokens=many", Budget{}, "bad tokens"},
+		{"hours=1", Budget{}, `unknown limit "hours"`},
+	} {
+		got, err := parseBudgetFlag(tt.spec)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseBudgetFlag(%q): err = %v, want %q", tt.spec, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseBudgetFlag(%q) = %+v, %v, want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestBudgetThroughProxy(t *testing.T) {
+	var sent atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","choices":[]}`))
+	}))
+	defer upstream.Close()
+	proxyURL, exchanges := startProxy(t, &Config{
+		Upstream: upstream.URL,
+		Budget:   BudgetConfig{Session: Budget{Requests: 1}},
+	})
+	post := func(session string) (int, string) {
+		t.Helper()
+		resp, err := http.Post(proxyURL+"/_session/"+session+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4o"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := post("eval-1"); status != http.StatusOK {
+		t.Fatalf("first request: %d %s", status, body)
+	}
+	status, body := post("eval-1")
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("over budget: status = %d, want 429", status)
+	}
+	want := `{"error":{"message":"proxy budget for session \"eval-1\" exceeded: 1 of 1 requests sent","type":"insufficient_quota"}}`
+	if !jsonEqual(t, []byte(body), []byte(want)) {
+		t.Errorf("over budget: body = %s\nwant %s", body, want)
+	}
+	if status, body := post("eval-2"); status != http.StatusOK {
+		t.Errorf("other session: %d %s", status, body)
+	}
+	if n := sent.Load(); n != 2 {
+		t.Errorf("%d requests sent upstream, want 2", n)
+	}
+	x := exchanges(3)[1]
+	if x.Session != "eval-1" || x.Status != http.StatusTooManyRequests || !strings.Contains(x.Error, "exceeded") {
+		t.Errorf("logged session %q, status %d, error %q, want the rejection", x.Session, x.Status, x.Error)
+	}
+}
+
+func TestBudgetSkipsLocalResponses(t *testing.T) {
+	var sent atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	cassette := filepath.Join(dir, "cassette.jsonl")
+	scenario := filepath.Join(dir, "scenario.json")
+	if err := os.WriteFile(scenario, []byte(`{"steps":[{"reply":{"content":"hi","usage":{"inputTokens":10,"outputTokens":5}}}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// a budget that stops the traffic after one request sent upstream
+	budget := BudgetConfig{Global: Budget{Requests: 1}}
+
+	for _, tt := range []struct {
+		name     string
+		cfg      *Config
+		requests int
+		// sent is the number of requests expected upstream.
+		sent int32
+	}{
+		// recording sends every request, and makes the cassette replayed
+		// below
+		{"record", &Config{Upstream: upstream.URL, Record: cassette, Budget: budget}, 1, 1},
+		{"cache", &Config{Upstream: upstream.URL, Cache: CacheConfig{Dir: filepath.Join(dir, "cache")}, Budget: budget}, 3, 1},
+		{"replay", &Config{Upstream: upstream.URL, Replay: cassette, Budget: budget}, 3, 0},
+		{"mock", &Config{Upstream: upstream.URL, Mock: scenario, Budget: budget}, 3, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sent.Store(0)
+			proxyURL, exchanges := startProxy(t, tt.cfg)
+			for i := range tt.requests {
+				resp, err := http.Post(proxyURL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				exchanges(i + 1)
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("request %d: status = %d, want 200", i, resp.StatusCode)
+				}
+			}
+			if n := sent.Load(); n != tt.sent {
+				t.Errorf("%d requests sent upstream, want %d", n, tt.sent)
+			}
+
+			resp, err := http.Get(proxyURL + "/_proxy/stats")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var stats struct {
+				Budgets struct{ Global spend }
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+				t.Fatal(err)
+			}
+			if spent := stats.Budgets.Global; spent.Requests != int64(tt.sent) || spent.Tokens != int64(tt.sent)*15 {
+				t.Errorf("spent %+v, want the %d requests sent upstream", spent, tt.sent)
+			}
+		})
+	}
+}
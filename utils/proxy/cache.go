@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheConfig enables the response cache.
+type CacheConfig struct {
+	// Dir is the directory holding the cached responses. The cache is off
+	// when it is empty.
+	Dir string `json:"dir"`
+	// TTL is how long a response is served from the cache, e.g. "24h".
+	// Defaults to 24 hours.
+	TTL string `json:"ttl"`
+	// Ignore lists the top-level request fields left out of the cache key,
+	// for fields that change from run to run without affecting the
+	// response. Defaults to "user" and "metadata".
+	Ignore []string `json:"ignore"`
+}
+
+// cacheHeader is set by clients to bypass the cache for one request, with
+// "bypass" to neither read nor store the response or "refresh" to store a
+// fresh one. Responses carry it too, to tell hits from misses.
+const cacheHeader = "X-Proxy-Cache"
+
+// Cache results, as reported in the traffic log and counters.
+const (
+	cacheHit    = "hit"
+	cacheMiss   = "miss"
+	cacheBypass = "bypass"
+)
+
+// cacheEntry is a cached response, stored as one JSON file per key.
+type cacheEntry struct {
+	Stored time.Time `json:"stored"`
+	Interaction
+}
+
+// responseCache is a content-addressed cache of upstream responses, keyed
+// on the tenant, upstream, method, path and canonical request body.
+type responseCache struct {
+	dir    string
+	ttl    time.Duration
+	ignore []string
+
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newResponseCache(cfg CacheConfig) (*responseCache, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+	c := &responseCache{dir: cfg.Dir, ttl: 24 * time.Hour, ignore: cfg.Ignore, counts: map[string]int64{}}
+	if cfg.TTL != "" {
+		d, err := time.ParseDuration(cfg.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("cache ttl: %w", err)
+		}
+		c.ttl = d
+	}
+	if c.ignore == nil {
+		c.ignore = []string{"user", "metadata"}
+	}
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create cache directory: %w", err)
+	}
+	return c, nil
+}
+
+// Key returns the cache key of a request, a hash of its upstream, method,
+// path and canonical body: JSON with sorted keys and without the ignored
+// fields. Requests of different tenants, the clients named by proxy tokens,
+// get different keys; without a tenant, the cache is shared.
+func (c *responseCache) Key(tenant, upstream, method, path string, body []byte) string {
+	canonical := normalizeBody(body)
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) == nil && fields != nil {
+		for _, name := range c.ignore {
+			delete(fields, name)
+		}
+		if data, err := json.Marshal(fields); err == nil {
+			canonical = normalizeBody(data)
+		}
+	}
+	scope := upstream
+	if tenant != "" {
+		scope = tenant + "\n" + upstream
+	}
+	sum := sha256.Sum256([]byte(scope + "\n" + interactionKey(method, path, []byte(canonical))))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *responseCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// Mode returns how a request uses the cache according to its cacheHeader:
+// reading and storing, only storing, or neither.
+func (c *responseCache) Mode(r *http.Request) (read, store bool) {
+	switch strings.ToLower(r.Header.Get(cacheHeader)) {
+	case "bypass":
+		return false, false
+	case "refresh":
+		return false, true
+	}
+	return true, true
+}
+
+// Lookup returns the fresh cached response for key, if any.
+func (c *responseCache) Lookup(key string) (*cacheEntry, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	e := &cacheEntry{}
+	if err := json.Unmarshal(data, e); err != nil || time.Since(e.Stored) > c.ttl {
+		return nil, false
+	}
+	return e, true
+}
+
+// Store saves a response under key. The file is written next to its
+// final location and renamed, so that concurrent readers never see a
+// partial entry.
+func (c *responseCache) Store(key string, in *Interaction) error {
+	data, err := json.Marshal(&cacheEntry{Stored: time.Now(), Interaction: *in})
+	if err != nil {
+		return err
+	}
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	err = errors.Join(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Serve writes a cached response.
+func (e *cacheEntry) Serve(w http.ResponseWriter) {
+	for k, vs := range e.Header {
+		w.Header()[k] = append([]string(nil), vs...)
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set(cacheHeader, cacheHit)
+	w.Header().Set("Age", fmt.Sprint(int(time.Since(e.Stored).Seconds())))
+	w.WriteHeader(e.Status)
+	w.Write(e.Body)
+}
+
+// Count adds a request to the hit, miss or bypass counter.
+func (c *responseCache) Count(result string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[result]++
+}
+
+// Snapshot returns the counters for the stats endpoint.
+func (c *responseCache) Snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]int64{
+		"hits":     c.counts[cacheHit],
+		"misses":   c.counts[cacheMiss],
+		"bypassed": c.counts[cacheBypass],
+	}
+}
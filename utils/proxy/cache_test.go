@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCacheTenants(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		vault VaultConfig
+		// auth sets the client identity of the two clients.
+		auth [2]func(*http.Request)
+		// shared reports whether the second client gets the response
+		// cached for the first.
+		shared bool
+	}{
+		{
+			name: "proxy tokens",
+			vault: VaultConfig{Tokens: []*ProxyToken{
+				{Name: "team-a", Token: "pxy-a"},
+				{Name: "team-b", Token: "pxy-b"},
+			}},
+			auth: [2]func(*http.Request){
+				func(r *http.Request) { r.Header.Set("Authorization", "Bearer pxy-a") },
+				func(r *http.Request) { r.Header.Set("Authorization", "Bearer pxy-b") },
+			},
+		},
+		{
+			name: "no tokens",
+			auth: [2]func(*http.Request){
+				func(r *http.Request) { r.Header.Set("X-Proxy-Client", "a") },
+				func(r *http.Request) { r.Header.Set("X-Proxy-Client", "b") },
+			},
+			shared: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"object":"chat.completion","choices":[]}`))
+			}))
+			defer upstream.Close()
+			proxyURL, exchanges := startProxy(t, &Config{
+				Upstream: upstream.URL,
+				Vault:    tt.vault,
+				Cache:    CacheConfig{Dir: t.TempDir()},
+			})
+			post := func(auth func(*http.Request)) string {
+				t.Helper()
+				req, _ := http.NewRequest(http.MethodPost, proxyURL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","temperature":0}`))
+				auth(req)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("status = %d", resp.StatusCode)
+				}
+				return resp.Header.Get(cacheHeader)
+			}
+
+			a, b := tt.auth[0], tt.auth[1]
+			want := []string{cacheMiss, cacheMiss, cacheHit, cacheHit}
+			if tt.shared {
+				want[1] = cacheHit
+			}
+			for i, auth := range []func(*http.Request){a, b, a, b} {
+				if got := post(auth); got != want[i] {
+					t.Errorf("request %d: %s = %q, want %q", i+1, cacheHeader, got, want[i])
+				}
+				// responses are cached by the time they are logged
+				exchanges(i + 1)
+			}
+			wantForwarded := int32(2)
+			if tt.shared {
+				wantForwarded = 1
+			}
+			if n := forwarded.Load(); n != wantForwarded {
+				t.Errorf("forwarded %d requests, want %d", n, wantForwarded)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Interaction is one recorded request/response pair. Cassettes are stored as
+// JSON lines, one interaction per line, in the order responses completed.
+type Interaction struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Request is the decoded request body, with secrets masked.
+	Request string      `json:"request"`
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	// Body is the response body exactly as received from the upstream,
+	// still content-encoded.
+	Body []byte `json:"body"`
+}
+
+// normalizeBody returns a canonical form of a request body used for
+// matching: JSON bodies are re-encoded with sorted keys and no insignificant
+// whitespace, anything else is compared byte for byte.
+func normalizeBody(body []byte) string {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return string(bytes.TrimSpace(body))
+	}
+	norm, err := json.Marshal(v)
+	if err != nil {
+		return string(body)
+	}
+	return string(norm)
+}
+
+func interactionKey(method, path string, body []byte) string {
+	return method + " " + path + "\n" + normalizeBody(body)
+}
+
+// cassetteRecorder appends interactions to a cassette file.
+type cassetteRecorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func newCassetteRecorder(path string) (*cassetteRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open cassette: %w", err)
+	}
+	return &cassetteRecorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (c *cassetteRecorder) Record(in *Interaction) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enc.Encode(in)
+}
+
+func (c *cassetteRecorder) Close() error {
+	return c.f.Close()
+}
+
+// cassettePlayer serves recorded interactions. Identical requests are
+// answered in the order they were recorded; once a request's recordings are
+// exhausted the last one keeps being served.
+type cassettePlayer struct {
+	mu     sync.Mutex
+	byKey  map[string][]*Interaction
+	served map[string]int
+}
+
+func loadCassette(path string) (*cassettePlayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open cassette: %w", err)
+	}
+	defer f.Close()
+
+	c := &cassettePlayer{
+		byKey:  map[string][]*Interaction{},
+		served: map[string]int{},
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		in := &Interaction{}
+		if err := json.Unmarshal(scanner.Bytes(), in); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		key := interactionKey(in.Method, in.Path, []byte(in.Request))
+		c.byKey[key] = append(c.byKey[key], in)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read cassette: %w", err)
+	}
+	return c, nil
+}
+
+func (c *cassettePlayer) Lookup(method, path string, body []byte) (*Interaction, bool) {
+	key := interactionKey(method, path, body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	recorded := c.byKey[key]
+	if len(recorded) == 0 {
+		return nil, false
+	}
+	i := min(c.served[key], len(recorded)-1)
+	c.served[key]++
+	return recorded[i], true
+}
+
+// Replay writes a recorded response, or a provider-shaped error when the
+// request has no recorded counterpart. It reports whether a recording was
+// found.
+func (c *cassettePlayer) Replay(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	in, ok := c.Lookup(r.Method, r.URL.Path, body)
+	if !ok {
+		writeMiss(w, "cassette_miss",
+			fmt.Sprintf("no recorded response for %s %s with this request body", r.Method, r.URL.Path))
+		return false
+	}
+	for k, vs := range in.Header {
+		// older cassettes hold the ID of the recorded exchange
+		if k == requestIDHeader {
+			continue
+		}
+		w.Header()[k] = append([]string(nil), vs...)
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(in.Status)
+	w.Write(in.Body)
+	return true
+}
+
+// writeMiss answers a request that an offline mode, replay or mock, has no
+// response for. It uses 404 rather than 5xx so that clients fail fast
+// instead of retrying.
+func writeMiss(w http.ResponseWriter, typ, message string) {
+	writeError(w, http.StatusNotFound, typ, message)
+}
+
+// writeError answers with an OpenAI-style error body.
+func writeError(w http.ResponseWriter, status int, typ, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    typ,
+		},
+	})
+}
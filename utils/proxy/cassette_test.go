@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplayRequestID(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","choices":[]}`))
+	}))
+	defer upstream.Close()
+	cassette := filepath.Join(t.TempDir(), "cassette.jsonl")
+	body := []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`)
+	post := func(proxyURL string) *http.Response {
+		t.Helper()
+		resp, err := http.Post(proxyURL+"/v1/chat/completions", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	proxyURL, exchanges := startProxy(t, &Config{Upstream: upstream.URL, Record: cassette})
+	recorded := post(proxyURL).Header.Get(requestIDHeader)
+	exchanges(1)
+	data, err := os.ReadFile(cassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(requestIDHeader)) {
+		t.Errorf("cassette stores %s: %s", requestIDHeader, data)
+	}
+
+	proxyURL, exchanges = startProxy(t, &Config{Upstream: upstream.URL, Replay: cassette})
+	resp := post(proxyURL)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want the recorded 200", resp.StatusCode)
+	}
+	replayed := resp.Header.Get(requestIDHeader)
+	logged := exchanges(1)[0].ID
+	if replayed != logged {
+		t.Errorf("%s = %q, want the logged ID %q", requestIDHeader, replayed, logged)
+	}
+	if replayed == recorded {
+		t.Errorf("%s = %q, the ID of the recorded exchange", requestIDHeader, replayed)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultTarget is the backend server to which requests are proxied when no
+// upstream is configured.
+const defaultTarget = "https://api.openai.com"
+
+// defaultSessionHeader is the request header grouping exchanges into
+// sessions when none is configured.
+const defaultSessionHeader = "X-Proxy-Session"
+
+// defaultListen is the address the proxy listens on when none is configured.
+const defaultListen = ":8080"
+
+// Config holds the proxy settings. It can be loaded from a JSON file passed
+// with -config; flags and PROXY_* environment variables take precedence.
+type Config struct {
+	// Listen is the address the proxy server listens on.
+	Listen string `json:"listen"`
+	// Upstream is the backend for requests that match no route.
+	Upstream string `json:"upstream"`
+	// Provider is the wire format of Upstream: openai, the default, or
+	// anthropic or gemini to translate chat completions to.
+	Provider string `json:"provider"`
+	// Credential is the API key sent to Upstream in place of the one of the
+	// client: env:NAME, file:PATH or the key itself.
+	Credential string `json:"credential"`
+	// Routes send requests under a path prefix to a dedicated upstream.
+	Routes []Route `json:"routes"`
+	// Vault authenticates clients with proxy tokens.
+	Vault VaultConfig `json:"vault"`
+	TLS   TLSConfig   `json:"tls"`
+	// Server sets the timeouts of the proxy server.
+	Server ServerConfig `json:"server"`
+	Redact RedactConfig `json:"redact"`
+	// Log is the file exchanges are written to as JSON lines; empty or "-"
+	// means stdout.
+	Log string `json:"log"`
+	// Pricing is a JSON file mapping model names to prices in dollars per
+	// million tokens.
+	Pricing string `json:"pricing"`
+	// SessionHeader names the request header that groups exchanges into
+	// sessions in the stats.
+	SessionHeader string `json:"sessionHeader"`
+	// Record appends every exchange to this cassette file.
+	Record string `json:"record"`
+	// Replay serves responses from this cassette file instead of contacting
+	// the upstreams.
+	Replay string `json:"replay"`
+	// Tracing exports a span per request to an OpenTelemetry collector.
+	Tracing TracingConfig `json:"tracing"`
+	// HAR is a HAR file kept up to date with the proxied exchanges.
+	HAR string `json:"har"`
+	// UIMemoryMB bounds the memory taken by the exchanges the web UI keeps,
+	// in megabytes. Defaults to 64.
+	UIMemoryMB int `json:"uiMemoryMB"`
+	// Cache serves repeated requests from a local response cache.
+	Cache CacheConfig `json:"cache"`
+	// Retry retries requests that fail with a transient upstream error.
+	Retry RetryConfig `json:"retry"`
+	// RateLimit paces the requests sent to the upstreams.
+	RateLimit RateLimitConfig `json:"rateLimit"`
+	// Budget stops the traffic of sessions, or of the proxy, that spent
+	// too much.
+	Budget BudgetConfig `json:"budget"`
+	// Rewrites patch the body of matching requests, in order.
+	Rewrites []*RewriteRule `json:"rewrites"`
+	// Faults are injected into matching requests, in order; the first
+	// rule that triggers wins.
+	Faults []*FaultRule `json:"faults"`
+	// Mock answers chat completions from this scenario file instead of
+	// contacting the upstreams.
+	Mock string `json:"mock"`
+}
+
+// Route maps a path prefix such as /anthropic/ to an upstream. The prefix is
+// stripped before the request is forwarded, so /anthropic/v1/messages reaches
+// the upstream as /v1/messages.
+type Route struct {
+	Prefix   string `json:"prefix"`
+	Upstream string `json:"upstream"`
+	// Provider is the wire format of the upstream, as for Config.Provider.
+	Provider string `json:"provider,omitempty"`
+	// Credential is the API key of the upstream, as for Config.Credential.
+	Credential string `json:"credential,omitempty"`
+}
+
+type TLSConfig struct {
+	// CertFile and KeyFile make the proxy itself serve HTTPS.
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// CAFile is an extra PEM bundle trusted when dialing upstreams, e.g. for
+	// a staging gateway with a private CA.
+	CAFile string `json:"caFile"`
+	// InsecureSkipVerify disables upstream certificate verification.
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+}
+
+// RedactConfig extends the built-in list of secrets masked in logs.
+type RedactConfig struct {
+	// Headers are extra header names masked entirely. They are also masked
+	// when they appear as JSON field names in bodies.
+	Headers []string `json:"headers"`
+	// Patterns are regular expressions masked in headers, bodies and URLs.
+	Patterns []string `json:"patterns"`
+}
+
+// listFlag collects repeated string flags.
+type listFlag []string
+
+func (lf *listFlag) String() string {
+	return strings.Join(*lf, ",")
+}
+
+func (lf *listFlag) Set(v string) error {
+	*lf = append(*lf, v)
+	return nil
+}
+
+// routeFlags collects repeated -route prefix=upstream flags. The upstream
+// may start with its provider, as in /claude=anthropic:https://api.anthropic.com.
+type routeFlags []Route
+
+func (rf *routeFlags) String() string {
+	var s []string
+	for _, r := range *rf {
+		upstream := r.Upstream
+		if r.Provider != "" {
+			upstream = r.Provider + ":" + upstream
+		}
+		s = append(s, r.Prefix+"="+upstream)
+	}
+	return strings.Join(s, ",")
+}
+
+func (rf *routeFlags) Set(v string) error {
+	prefix, upstream, ok := strings.Cut(v, "=")
+	if !ok || prefix == "" || upstream == "" {
+		return fmt.Errorf("expected prefix=upstream, got %q", v)
+	}
+	route := Route{Prefix: prefix, Upstream: upstream}
+	if provider, rest, ok := strings.Cut(upstream, ":"); ok && provider != "" && validProvider(provider) {
+		route.Provider, route.Upstream = provider, rest
+	}
+	*rf = append(*rf, route)
+	return nil
+}
+
+// loadConfig builds the configuration from, in increasing order of
+// precedence: built-in defaults, the config file, PROXY_* environment
+// variables and command-line flags.
+func loadConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("PROXY_CONFIG"), "path to a JSON config file (env PROXY_CONFIG)")
+	fs.String("listen", "", "address to listen on (env PROXY_LISTEN, default "+defaultListen+")")
+	fs.String("upstream", "", "default upstream URL (env PROXY_UPSTREAM, default "+defaultTarget+")")
+	fs.String("provider", "", "wire format of the default upstream: openai, anthropic or gemini (env PROXY_PROVIDER, default openai)")
+	fs.String("upstream-key", "", "API key sent to the default upstream instead of the client's, as env:NAME, file:PATH or the key (env PROXY_UPSTREAM_KEY)")
+	fs.String("tokens", "", "JSON file of the proxy tokens clients must authenticate with (env PROXY_TOKENS)")
+	fs.String("shutdown-timeout", "", "how long in-flight requests may run on after SIGINT or SIGTERM (env PROXY_SHUTDOWN_TIMEOUT, default 30s)")
+	fs.String("tls-cert", "", "serve HTTPS with this certificate (env PROXY_TLS_CERT)")
+	fs.String("tls-key", "", "serve HTTPS with this key (env PROXY_TLS_KEY)")
+	fs.String("upstream-ca", "", "extra PEM CA bundle trusted for upstreams (env PROXY_UPSTREAM_CA)")
+	fs.String("insecure-skip-verify", "", "skip upstream certificate verification (env PROXY_INSECURE_SKIP_VERIFY)")
+	fs.String("log", "", "write the JSONL traffic log to this file instead of stdout (env PROXY_LOG)")
+	fs.String("pricing", "", "JSON pricing table used to compute costs (env PROXY_PRICING)")
+	fs.String("session-header", "", "request header identifying sessions (env PROXY_SESSION_HEADER, default "+defaultSessionHeader+")")
+	fs.String("record", "", "record exchanges to this cassette file (env PROXY_RECORD)")
+	fs.String("replay", "", "serve responses from this cassette file, offline (env PROXY_REPLAY)")
+	fs.String("mock", "", "serve chat completions from this scenario file, offline (env PROXY_MOCK)")
+	fs.String("otlp-endpoint", "", "export request spans to this OTLP/HTTP collector (env PROXY_OTLP_ENDPOINT)")
+	fs.String("har", "", "also write the traffic to this HAR file (env PROXY_HAR)")
+	fs.String("cache", "", "cache responses in this directory (env PROXY_CACHE)")
+	fs.String("cache-ttl", "", "how long cached responses are served (env PROXY_CACHE_TTL, default 24h)")
+	var routes routeFlags
+	fs.Var(&routes, "route", "route a path prefix to an upstream, as prefix=URL or prefix=provider:URL (repeatable)")
+	fs.Float64("upstream-rpm", 0, "requests per minute allowed to each upstream, 0 for unlimited (env PROXY_UPSTREAM_RPM)")
+	fs.Float64("upstream-tpm", 0, "tokens per minute allowed to each upstream, 0 for unlimited (env PROXY_UPSTREAM_TPM)")
+	var budget, sessionBudget string
+	fs.StringVar(&budget, "budget", "", "stop all traffic once it spent this budget, as usd=5,tokens=2000000,requests=500 (env PROXY_BUDGET)")
+	fs.StringVar(&sessionBudget, "session-budget", "", "stop the traffic of each session once it spent this budget, as for -budget (env PROXY_SESSION_BUDGET)")
+	fs.Int("retry", 0, "attempts made for requests failing with a transient upstream error, 0 or 1 to disable (env PROXY_RETRY)")
+	fs.Int("ui-memory-mb", 0, "megabytes of recent exchanges kept for the web UI (env PROXY_UI_MEMORY_MB, default 64)")
+	var sets listFlag
+	fs.Var(&sets, "set", "set a request field, as path=JSON value, e.g. temperature=0 or model=gpt-4o-mini (repeatable)")
+	var faults listFlag
+	fs.Var(&faults, "fault", "inject a fault: 429, 503, drop, malformed, truncate[=bytes] or latency=5s, with an optional @probability (repeatable)")
+	var redactHeaders, redactPatterns listFlag
+	fs.Var(&redactHeaders, "redact-header", "header to mask in logs, in addition to the built-in ones (repeatable)")
+	fs.Var(&redactPatterns, "redact-pattern", "regular expression to mask in logs (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return nil, fmt.Errorf("read config: %w", err)
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parse config %s: %w", *configFile, err)
+		}
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	str := func(dst *string, name, env, def string) {
+		switch {
+		case set[name]:
+			*dst = fs.Lookup(name).Value.String()
+		case os.Getenv(env) != "":
+			*dst = os.Getenv(env)
+		case *dst == "":
+			*dst = def
+		}
+	}
+	str(&cfg.Listen, "listen", "PROXY_LISTEN", defaultListen)
+	str(&cfg.Upstream, "upstream", "PROXY_UPSTREAM", defaultTarget)
+	str(&cfg.Provider, "provider", "PROXY_PROVIDER", "")
+	str(&cfg.Credential, "upstream-key", "PROXY_UPSTREAM_KEY", "")
+	str(&cfg.Vault.TokensFile, "tokens", "PROXY_TOKENS", "")
+	str(&cfg.Server.ShutdownTimeout, "shutdown-timeout", "PROXY_SHUTDOWN_TIMEOUT", "")
+	str(&cfg.TLS.CertFile, "tls-cert", "PROXY_TLS_CERT", "")
+	str(&cfg.TLS.KeyFile, "tls-key", "PROXY_TLS_KEY", "")
+	str(&cfg.TLS.CAFile, "upstream-ca", "PROXY_UPSTREAM_CA", "")
+	str(&cfg.Log, "log", "PROXY_LOG", "")
+	str(&cfg.Pricing, "pricing", "PROXY_PRICING", "")
+	str(&cfg.SessionHeader, "session-header", "PROXY_SESSION_HEADER", defaultSessionHeader)
+	str(&cfg.Record, "record", "PROXY_RECORD", "")
+	str(&cfg.Replay, "replay", "PROXY_REPLAY", "")
+	str(&cfg.Mock, "mock", "PROXY_MOCK", "")
+	str(&cfg.Tracing.Endpoint, "otlp-endpoint", "PROXY_OTLP_ENDPOINT", "")
+	str(&cfg.HAR, "har", "PROXY_HAR", "")
+	str(&cfg.Cache.Dir, "cache", "PROXY_CACHE", "")
+	str(&cfg.Cache.TTL, "cache-ttl", "PROXY_CACHE_TTL", "")
+
+	var insecure string
+	str(&insecure, "insecure-skip-verify", "PROXY_INSECURE_SKIP_VERIFY", "")
+	if insecure != "" {
+		v, err := strconv.ParseBool(insecure)
+		if err != nil {
+			return nil, fmt.Errorf("insecure-skip-verify: %w", err)
+		}
+		cfg.TLS.InsecureSkipVerify = v
+	}
+
+	cfg.Routes = append(cfg.Routes, routes...)
+	for _, n := range []struct {
+		name, env string
+		parse     func(string) error
+	}{
+		{"upstream-rpm", "PROXY_UPSTREAM_RPM", func(v string) (err error) {
+			cfg.RateLimit.Upstream.RequestsPerMinute, err = strconv.ParseFloat(v, 64)
+			return err
+		}},
+		{"upstream-tpm", "PROXY_UPSTREAM_TPM", func(v string) (err error) {
+			cfg.RateLimit.Upstream.TokensPerMinute, err = strconv.ParseFloat(v, 64)
+			return err
+		}},
+		{"retry", "PROXY_RETRY", func(v string) (err error) {
+			cfg.Retry.MaxAttempts, err = strconv.Atoi(v)
+			return err
+		}},
+		{"ui-memory-mb", "PROXY_UI_MEMORY_MB", func(v string) (err error) {
+			cfg.UIMemoryMB, err = strconv.Atoi(v)
+			return err
+		}},
+	} {
+		var v string
+		str(&v, n.name, n.env, "")
+		if v == "" {
+			continue
+		}
+		if err := n.parse(v); err != nil {
+			return nil, fmt.Errorf("%s: %w", n.name, err)
+		}
+	}
+	for _, b := range []struct {
+		dst             *Budget
+		name, env, spec string
+	}{
+		{&cfg.Budget.Global, "budget", "PROXY_BUDGET", budget},
+		{&cfg.Budget.Session, "session-budget", "PROXY_SESSION_BUDGET", sessionBudget},
+	} {
+		if !set[b.name] {
+			b.spec = os.Getenv(b.env)
+		}
+		if b.spec == "" {
+			continue
+		}
+		v, err := parseBudgetFlag(b.spec)
+		if err != nil {
+			return nil, err
+		}
+		*b.dst = v
+	}
+	for _, spec := range sets {
+		rule, err := parseSetFlag(spec)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Rewrites = append(cfg.Rewrites, rule)
+	}
+	for _, spec := range faults {
+		f, err := parseFaultFlag(spec)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Faults = append(cfg.Faults, f)
+	}
+	cfg.Redact.Headers = append(cfg.Redact.Headers, redactHeaders...)
+	cfg.Redact.Patterns = append(cfg.Redact.Patterns, redactPatterns...)
+
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return nil, errors.New("tls-cert and tls-key must be set together")
+	}
+	modes := 0
+	for _, mode := range []string{cfg.Record, cfg.Replay, cfg.Mock} {
+		if mode != "" {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return nil, errors.New("record, replay and mock are mutually exclusive")
+	}
+	return cfg, nil
+}
+
+// upstreamTransport returns the transport used to reach upstreams, honoring
+// the upstream TLS settings.
+func (cfg *Config) upstreamTransport() (http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.TLS.CAFile == "" && !cfg.TLS.InsecureSkipVerify {
+		return transport, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.TLS.InsecureSkipVerify} //#nosec
+	if cfg.TLS.CAFile != "" {
+		pem, err := os.ReadFile(cfg.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read upstream CA: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.TLS.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// errDiverged reports that the sessions compared by proxy diff differ.
+var errDiverged = errors.New("sessions diverged")
+
+// Things that differ between two turns.
+const (
+	changePrompt    = "prompt"
+	changeToolCalls = "toolCalls"
+	changeArguments = "arguments"
+	changeMissing   = "missing"
+)
+
+// Turn is one chat completion of a session: the messages the client added
+// since the last assistant message, and the tool calls the model answered
+// with.
+type Turn struct {
+	ID        string          `json:"id"`
+	Model     string          `json:"model,omitempty"`
+	Prompt    []string        `json:"prompt"`
+	Content   string          `json:"content,omitempty"`
+	ToolCalls []*TurnToolCall `json:"toolCalls,omitempty"`
+	Usage     *Usage          `json:"usage,omitempty"`
+}
+
+// TurnToolCall is a tool call chosen by the model, with its arguments
+// normalized so that key order does not matter.
+type TurnToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// SessionSummary describes one side of a diff.
+type SessionSummary struct {
+	Log     string   `json:"log"`
+	Session string   `json:"session"`
+	Models  []string `json:"models"`
+	Turns   int      `json:"turns"`
+	Usage   Usage    `json:"usage"`
+	CostUSD float64  `json:"costUsd"`
+}
+
+// TurnDiff compares the turns of two sessions at the same position.
+type TurnDiff struct {
+	Turn int   `json:"turn"`
+	A    *Turn `json:"a,omitempty"`
+	B    *Turn `json:"b,omitempty"`
+	// Changes are what differs: prompt, toolCalls, arguments, or missing
+	// when only one session got that far.
+	Changes []string `json:"changes,omitempty"`
+}
+
+// SessionDiff compares two recorded sessions turn by turn.
+type SessionDiff struct {
+	A *SessionSummary `json:"a"`
+	B *SessionSummary `json:"b"`
+	// Diverged is the first turn that differs, 0 when none does.
+	Diverged int         `json:"diverged,omitempty"`
+	Turns    []*TurnDiff `json:"turns"`
+}
+
+func diffCommand(args []string) error {
+	fs := flag.NewFlagSet("proxy diff", flag.ContinueOnError)
+	a := fs.String("a", "", "session of the first log to compare, needed when it holds several")
+	b := fs.String("b", "", "session of the last log to compare, needed when it holds several")
+	asJSON := fs.Bool("json", false, "write the diff as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: proxy diff [-a session] [-b session] [-json] traffic.jsonl [other.jsonl]")
+		fmt.Fprintln(fs.Output(), "Compares two sessions of traffic logs turn by turn: prompts, tool calls, their arguments and token usage.")
+		fmt.Fprintln(fs.Output(), "Sessions match the session or trace of exchanges. Exits with 1 when they diverge.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	logA, logB := fs.Arg(0), fs.Arg(fs.NArg()-1)
+	summaryA, turnsA, err := loadSession(logA, *a)
+	if err != nil {
+		return err
+	}
+	summaryB, turnsB, err := loadSession(logB, *b)
+	if err != nil {
+		return err
+	}
+	d := diffSessions(summaryA, turnsA, summaryB, turnsB)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(d)
+	} else {
+		err = d.WriteText(os.Stdout)
+	}
+	if err != nil {
+		return err
+	}
+	if d.Diverged > 0 {
+		return errDiverged
+	}
+	return nil
+}
+
+// loadSession reads the turns of session from a traffic log. An empty
+// session selects the only one the log holds.
+func loadSession(path, session string) (*SessionSummary, []*Turn, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var exchanges []*Exchange
+	sessions := map[string]bool{}
+	err = readExchanges(f, func(x *Exchange) error {
+		if x.Session != "" {
+			sessions[x.Session] = true
+		}
+		if session == "" || x.Session == session || x.Trace == session {
+			exchanges = append(exchanges, x)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if session == "" && len(sessions) > 1 {
+		names := make([]string, 0, len(sessions))
+		for name := range sessions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, nil, fmt.Errorf("%s holds %d sessions, pick one: %s", path, len(names), strings.Join(names, ", "))
+	}
+	if session == "" && len(sessions) == 1 {
+		for name := range sessions {
+			session = name
+		}
+	}
+	sort.SliceStable(exchanges, func(i, j int) bool {
+		return exchanges[i].Start.Before(exchanges[j].Start)
+	})
+
+	summary := &SessionSummary{Log: path, Session: session, Models: []string{}}
+	var turns []*Turn
+	for _, x := range exchanges {
+		t := turnOf(x)
+		if t == nil {
+			continue
+		}
+		turns = append(turns, t)
+		if t.Model != "" && !slices.Contains(summary.Models, t.Model) {
+			summary.Models = append(summary.Models, t.Model)
+		}
+		if t.Usage != nil {
+			summary.Usage.Add(*t.Usage)
+		}
+		summary.CostUSD += x.CostUSD
+	}
+	if len(turns) == 0 {
+		return nil, nil, fmt.Errorf("%s: no chat completion in session %q", path, session)
+	}
+	summary.Turns = len(turns)
+	return summary, turns, nil
+}
+
+// turnOf returns the turn of a successful chat completion, or nil for other
+// exchanges, such as failed attempts retried by the client.
+func turnOf(x *Exchange) *Turn {
+	if x.Status < 200 || x.Status >= 300 {
+		return nil
+	}
+	var req chatRequest
+	var resp chatCompletion
+	if json.Unmarshal(x.Request, &req) != nil || len(req.Messages) == 0 ||
+		json.Unmarshal(x.Response, &resp) != nil || len(resp.Choices) == 0 {
+		return nil
+	}
+	t := &Turn{ID: x.ID, Model: x.Model, Usage: x.Usage, Prompt: []string{}}
+	if t.Model == "" {
+		t.Model = req.Model
+	}
+	// the earlier messages were the prompts of the previous turns
+	start := 0
+	for i, m := range req.Messages {
+		if m.Role == "assistant" {
+			start = i + 1
+		}
+	}
+	for _, m := range req.Messages[start:] {
+		t.Prompt = append(t.Prompt, m.Role+": "+m.Text())
+	}
+	if m := resp.Choices[0].Message; m != nil {
+		t.Content = m.Content
+		for _, call := range m.ToolCalls {
+			t.ToolCalls = append(t.ToolCalls, &TurnToolCall{Name: call.Function.Name, Arguments: normalizeArguments(call.Function.Arguments)})
+		}
+	}
+	return t
+}
+
+// normalizeArguments re-encodes the JSON arguments of a tool call with
+// sorted keys, keeping them as a string when they are not JSON.
+func normalizeArguments(args string) json.RawMessage {
+	var v any
+	if json.Unmarshal([]byte(args), &v) == nil {
+		if data, err := json.Marshal(v); err == nil {
+			return data
+		}
+	}
+	data, _ := json.Marshal(args)
+	return data
+}
+
+func diffSessions(a *SessionSummary, turnsA []*Turn, b *SessionSummary, turnsB []*Turn) *SessionDiff {
+	d := &SessionDiff{A: a, B: b}
+	for i := 0; i < max(len(turnsA), len(turnsB)); i++ {
+		td := &TurnDiff{Turn: i + 1}
+		if i < len(turnsA) {
+			td.A = turnsA[i]
+		}
+		if i < len(turnsB) {
+			td.B = turnsB[i]
+		}
+		td.Changes = compareTurns(td.A, td.B)
+		if len(td.Changes) > 0 && d.Diverged == 0 {
+			d.Diverged = td.Turn
+		}
+		d.Turns = append(d.Turns, td)
+	}
+	return d
+}
+
+func compareTurns(a, b *Turn) []string {
+	if a == nil || b == nil {
+		return []string{changeMissing}
+	}
+	var changes []string
+	if !reflect.DeepEqual(a.Prompt, b.Prompt) {
+		changes = append(changes, changePrompt)
+	}
+	if !reflect.DeepEqual(toolNames(a), toolNames(b)) {
+		return append(changes, changeToolCalls)
+	}
+	for i := range a.ToolCalls {
+		if string(a.ToolCalls[i].Arguments) != string(b.ToolCalls[i].Arguments) {
+			return append(changes, changeArguments)
+		}
+	}
+	return changes
+}
+
+func toolNames(t *Turn) []string {
+	names := []string{}
+	for _, call := range t.ToolCalls {
+		names = append(names, call.Name)
+	}
+	return names
+}
+
+// WriteText writes the diff for humans: a summary of each session, then
+// each turn with its token usage and what changed.
+func (d *SessionDiff) WriteText(w io.Writer) error {
+	var b strings.Builder
+	for _, side := range []struct {
+		name string
+		s    *SessionSummary
+	}{{"a", d.A}, {"b", d.B}} {
+		fmt.Fprintf(&b, "%s: session %q in %s: %d turns, %s, %s tokens, $%.4f\n",
+			side.name, side.s.Session, side.s.Log, side.s.Turns, strings.Join(side.s.Models, ", "), usageText(&side.s.Usage), side.s.CostUSD)
+	}
+	if d.Diverged > 0 {
+		fmt.Fprintf(&b, "diverged at turn %d\n", d.Diverged)
+	} else {
+		fmt.Fprintln(&b, "same prompts and tool calls")
+	}
+	for _, td := range d.Turns {
+		fmt.Fprintf(&b, "\nturn %d", td.Turn)
+		if td.A == nil || td.B == nil {
+			only := "a"
+			if td.A == nil {
+				only = "b"
+			}
+			fmt.Fprintf(&b, ": only in %s\n", only)
+			continue
+		}
+		fmt.Fprintf(&b, ": %s tokens | %s\n", usageText(td.A.Usage), usageText(td.B.Usage))
+		for _, change := range td.Changes {
+			switch change {
+			case changePrompt:
+				fmt.Fprintln(&b, "  prompt:")
+				sides(&b, strings.Join(td.A.Prompt, " / "), strings.Join(td.B.Prompt, " / "))
+			case changeToolCalls:
+				fmt.Fprintln(&b, "  tool calls:")
+				sides(&b, toolCallsText(td.A), toolCallsText(td.B))
+			case changeArguments:
+				for i, call := range td.A.ToolCalls {
+					other := td.B.ToolCalls[i]
+					if string(call.Arguments) != string(other.Arguments) {
+						fmt.Fprintf(&b, "  arguments of %s:\n", call.Name)
+						sides(&b, string(call.Arguments), string(other.Arguments))
+					}
+				}
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func sides(b *strings.Builder, a, other string) {
+	fmt.Fprintf(b, "    a: %s\n    b: %s\n", ellipsis(a), ellipsis(other))
+}
+
+func usageText(u *Usage) string {
+	if u == nil {
+		return "?"
+	}
+	return fmt.Sprintf("%d+%d", u.InputTokens, u.OutputTokens)
+}
+
+func toolCallsText(t *Turn) string {
+	if len(t.ToolCalls) == 0 {
+		return "(none)"
+	}
+	return strings.Join(toolNames(t), ", ")
+}
+
+// ellipsis shortens s to a line of at most 100 characters.
+func ellipsis(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > 100 {
+		return string(r[:99]) + "…"
+	}
+	return s
+}
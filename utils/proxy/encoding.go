@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// decodeFunc wraps an encoded body with its decoder.
+type decodeFunc func(io.Reader) (io.Reader, error)
+
+// decoderFor returns the decoder for a Content-Encoding header value, or nil
+// for identity. Stacked encodings such as "gzip, br" are undone in reverse
+// order of application.
+func decoderFor(contentEncoding string) (decodeFunc, error) {
+	var decoders []decodeFunc
+	for _, enc := range strings.Split(contentEncoding, ",") {
+		enc = strings.ToLower(strings.TrimSpace(enc))
+		switch enc {
+		case "", "identity":
+		case "br":
+			decoders = append(decoders, func(r io.Reader) (io.Reader, error) {
+				return brotli.NewReader(r), nil
+			})
+		case "gzip", "x-gzip":
+			decoders = append(decoders, func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			})
+		case "deflate":
+			decoders = append(decoders, newDeflateReader)
+		case "zstd":
+			decoders = append(decoders, func(r io.Reader) (io.Reader, error) {
+				d, err := zstd.NewReader(r)
+				if err != nil {
+					return nil, err
+				}
+				return zstdReader{d}, nil
+			})
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", enc)
+		}
+	}
+	if len(decoders) == 0 {
+		return nil, nil
+	}
+	return func(r io.Reader) (io.Reader, error) {
+		for i := len(decoders) - 1; i >= 0; i-- {
+			var err error
+			if r, err = decoders[i](r); err != nil {
+				return nil, err
+			}
+		}
+		return r, nil
+	}, nil
+}
+
+// undecodableBody stands in the log for a body in an encoding the proxy
+// cannot decode, rather than its encoded bytes.
+func undecodableBody(contentEncoding string, size int64) json.RawMessage {
+	data, _ := json.Marshal(map[string]any{"encoding": contentEncoding, "bytes": size})
+	return data
+}
+
+// newDeflateReader decodes "deflate" bodies, which per RFC 9110 are
+// zlib-wrapped but are sent as raw deflate by some servers.
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// zstdReader adapts a zstd decoder to io.ReadCloser.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (z zstdReader) Close() error {
+	z.Decoder.Close()
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// startProxy serves cfg, logging to a temporary file, and returns the proxy
+// URL along with a function waiting for n exchanges to be logged. Exchanges
+// are logged once the response is sent, so they may lag behind the client.
+func startProxy(t *testing.T, cfg *Config) (string, func(n int) []*Exchange) {
+	t.Helper()
+	cfg.Log = filepath.Join(t.TempDir(), "traffic.jsonl")
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.mux())
+	t.Cleanup(func() {
+		srv.Close()
+		s.traffic.Close()
+	})
+	return srv.URL, func(n int) []*Exchange {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var exchanges []*Exchange
+			data, err := os.ReadFile(cfg.Log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec := json.NewDecoder(bytes.NewReader(data))
+			for dec.More() {
+				x := &Exchange{}
+				if err := dec.Decode(x); err != nil {
+					t.Fatal(err)
+				}
+				exchanges = append(exchanges, x)
+			}
+			if len(exchanges) >= n || time.Now().After(deadline) {
+				if len(exchanges) != n {
+					t.Fatalf("logged %d exchanges, want %d", len(exchanges), n)
+				}
+				return exchanges
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func encode(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "", "identity":
+		return body
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			t.Fatal(err)
+		}
+	case "zstd":
+		var err error
+		if w, err = zstd.NewWriter(&buf); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("unknown encoding %q", encoding)
+	}
+	if _, err := w.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestResponseEncodings(t *testing.T) {
+	body := []byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hello, hello, hello"}}]}`)
+	for _, tt := range []struct {
+		name     string
+		encoding string
+		header   string
+	}{
+		{"identity", "identity", "identity"},
+		{"none", "", ""},
+		{"br", "br", "br"},
+		{"gzip", "gzip", "gzip"},
+		{"deflate zlib", "deflate", "deflate"},
+		{"deflate raw", "raw-deflate", "deflate"},
+		{"zstd", "zstd", "zstd"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := encode(t, tt.encoding, body)
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if tt.header != "" {
+					w.Header().Set("Content-Encoding", tt.header)
+				}
+				w.Write(encoded)
+			}))
+			defer upstream.Close()
+			proxyURL, exchanges := startProxy(t, &Config{Upstream: upstream.URL})
+
+			// Accepting the encodings explicitly keeps both the client and the
+			// proxy transport from decoding gzip themselves.
+			req, _ := http.NewRequest(http.MethodPost, proxyURL+"/v1/chat/completions", bytes.NewReader([]byte(`{"model":"gpt-4o"}`)))
+			req.Header.Set("Accept-Encoding", "br, gzip, deflate, zstd")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, encoded) {
+				t.Errorf("client body was modified: got %d bytes, want the %d bytes sent", len(got), len(encoded))
+			}
+			if h := resp.Header.Get("Content-Encoding"); h != tt.header {
+				t.Errorf("Content-Encoding = %q, want %q", h, tt.header)
+			}
+
+			logged := exchanges(1)
+			if !jsonEqual(t, logged[0].Response, body) {
+				t.Errorf("logged response = %s, want %s", logged[0].Response, body)
+			}
+			if logged[0].ResponseBytes != int64(len(encoded)) {
+				t.Errorf("responseBytes = %d, want %d", logged[0].ResponseBytes, len(encoded))
+			}
+		})
+	}
+}
+
+func TestRequestEncodings(t *testing.T) {
+	body := []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`)
+	for _, encoding := range []string{"identity", "br", "gzip", "deflate", "zstd"} {
+		t.Run(encoding, func(t *testing.T) {
+			encoded := encode(t, encoding, body)
+			var received []byte
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received, _ = io.ReadAll(r.Body)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{}`))
+			}))
+			defer upstream.Close()
+			proxyURL, exchanges := startProxy(t, &Config{Upstream: upstream.URL})
+
+			req, _ := http.NewRequest(http.MethodPost, proxyURL+"/v1/chat/completions", bytes.NewReader(encoded))
+			req.Header.Set("Content-Encoding", encoding)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if !bytes.Equal(received, encoded) {
+				t.Errorf("upstream body was modified: got %d bytes, want the %d bytes sent", len(received), len(encoded))
+			}
+			logged := exchanges(1)
+			if !jsonEqual(t, logged[0].Request, body) {
+				t.Errorf("logged request = %s, want %s", logged[0].Request, body)
+			}
+		})
+	}
+}
+
+func TestUnsupportedEncodingLogged(t *testing.T) {
+	encoded := []byte("\x1f\x9d\x90 not decodable")
+	var received []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "compress")
+		w.Write(encoded)
+	}))
+	defer upstream.Close()
+	proxyURL, exchanges := startProxy(t, &Config{Upstream: upstream.URL})
+
+	req, _ := http.NewRequest(http.MethodPost, proxyURL+"/v1/chat/completions", bytes.NewReader(encoded))
+	req.Header.Set("Content-Encoding", "compress")
+	req.Header.Set("Accept-Encoding", "compress")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(received, encoded) || !bytes.Equal(got, encoded) {
+		t.Error("body was modified")
+	}
+
+	logged := exchanges(1)[0]
+	want := []byte(fmt.Sprintf(`{"encoding":"compress","bytes":%d}`, len(encoded)))
+	if !jsonEqual(t, logged.Request, want) {
+		t.Errorf("logged request = %s, want %s", logged.Request, want)
+	}
+	if !jsonEqual(t, logged.Response, want) {
+		t.Errorf("logged response = %s, want %s", logged.Response, want)
+	}
+}
+
+func TestDecoderForUnsupported(t *testing.T) {
+	if _, err := decoderFor("compress"); err == nil {
+		t.Error("decoderFor(compress) succeeded, want an error")
+	}
+}
+
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb any
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("invalid JSON %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("invalid JSON %s: %v", b, err)
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
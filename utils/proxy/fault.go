@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestMatch selects requests by path prefix, model and headers. Empty
+// fields match everything.
+type RequestMatch struct {
+	Path   string            `json:"path"`
+	Model  string            `json:"model"`
+	Header map[string]string `json:"header"`
+}
+
+func (m *RequestMatch) matches(r *http.Request, model string) bool {
+	if m.Path != "" && !strings.HasPrefix(r.URL.Path, m.Path) {
+		return false
+	}
+	if m.Model != "" && m.Model != model {
+		return false
+	}
+	for name, value := range m.Header {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Fault kinds.
+const (
+	// faultStatus answers with an error status, e.g. 429 or 503.
+	faultStatus = "status"
+	// faultLatency delays the request before forwarding it.
+	faultLatency = "latency"
+	// faultTruncate cuts the response off and drops the connection.
+	faultTruncate = "truncate"
+	// faultMalformed answers with invalid JSON.
+	faultMalformed = "malformed"
+	// faultDrop closes the connection without answering.
+	faultDrop = "drop"
+)
+
+// FaultRule injects a fault into matching requests.
+type FaultRule struct {
+	Kind  string       `json:"kind"`
+	Match RequestMatch `json:"match"`
+	// Probability is the chance that a matching request triggers the
+	// fault; unset means always.
+	Probability *float64 `json:"probability"`
+	// Burst makes a triggered fault also hit the next Burst-1 matching
+	// requests.
+	Burst int `json:"burst"`
+
+	// Status and RetryAfter configure status faults. Status defaults to
+	// 500.
+	Status     int    `json:"status"`
+	RetryAfter string `json:"retryAfter"`
+	// Latency is the delay of latency faults, e.g. "5s".
+	Latency string `json:"latency"`
+	// TruncateAfter is the number of response bytes sent before a truncate
+	// fault drops the connection. Defaults to 256.
+	TruncateAfter int64 `json:"truncateAfter"`
+
+	latency time.Duration
+}
+
+func (f *FaultRule) String() string {
+	switch f.Kind {
+	case faultStatus:
+		return fmt.Sprintf("%s %d", f.Kind, f.Status)
+	case faultLatency:
+		return fmt.Sprintf("%s %s", f.Kind, f.latency)
+	case faultTruncate:
+		return fmt.Sprintf("%s after %d bytes", f.Kind, f.TruncateAfter)
+	}
+	return f.Kind
+}
+
+// parseFaultFlag parses the -fault shorthand: a status code, "drop",
+// "malformed", "truncate[=bytes]" or "latency=duration", optionally
+// followed by @probability, as in 429@0.1 or latency=5s@0.5.
+func parseFaultFlag(spec string) (*FaultRule, error) {
+	f := &FaultRule{}
+	kind, prob, ok := strings.Cut(spec, "@")
+	if ok {
+		p, err := strconv.ParseFloat(prob, 64)
+		if err != nil {
+			return nil, fmt.Errorf("fault %q: bad probability: %w", spec, err)
+		}
+		f.Probability = &p
+	}
+	kind, arg, _ := strings.Cut(kind, "=")
+	if status, err := strconv.Atoi(kind); err == nil {
+		f.Kind = faultStatus
+		f.Status = status
+		if status == http.StatusTooManyRequests {
+			f.RetryAfter = "1"
+		}
+		return f, nil
+	}
+	f.Kind = kind
+	switch kind {
+	case faultLatency:
+		f.Latency = arg
+	case faultTruncate:
+		if arg != "" {
+			n, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("fault %q: bad byte count: %w", spec, err)
+			}
+			f.TruncateAfter = n
+		}
+	}
+	return f, nil
+}
+
+// faultInjector picks the fault, if any, to inject into each request.
+type faultInjector struct {
+	rules []*FaultRule
+
+	mu sync.Mutex
+	// burst counts the requests each rule still has to hit.
+	burst map[*FaultRule]int
+}
+
+func newFaultInjector(rules []*FaultRule) (*faultInjector, error) {
+	for _, f := range rules {
+		switch f.Kind {
+		case faultStatus:
+			if f.Status == 0 {
+				f.Status = http.StatusInternalServerError
+			}
+		case faultLatency:
+			d, err := time.ParseDuration(f.Latency)
+			if err != nil {
+				return nil, fmt.Errorf("latency fault: %w", err)
+			}
+			f.latency = d
+		case faultTruncate:
+			if f.TruncateAfter == 0 {
+				f.TruncateAfter = 256
+			}
+		case faultMalformed, faultDrop:
+		default:
+			return nil, fmt.Errorf("unknown fault kind %q", f.Kind)
+		}
+	}
+	return &faultInjector{rules: rules, burst: map[*FaultRule]int{}}, nil
+}
+
+// Pick returns the first matching rule that triggers for the request.
+func (fi *faultInjector) Pick(r *http.Request, model string) *FaultRule {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	for _, f := range fi.rules {
+		if !f.Match.matches(r, model) {
+			continue
+		}
+		if fi.burst[f] > 0 {
+			fi.burst[f]--
+			return f
+		}
+		if f.Probability != nil && rand.Float64() >= *f.Probability {
+			continue
+		}
+		if f.Burst > 1 {
+			fi.burst[f] = f.Burst - 1
+		}
+		return f
+	}
+	return nil
+}
+
+// Inject applies the fault to the exchange. It reports whether the request
+// was answered by the fault and must not be forwarded.
+func (f *FaultRule) Inject(rw *responseWriter, r *http.Request, body []byte) bool {
+	switch f.Kind {
+	case faultLatency:
+		select {
+		case <-time.After(f.latency):
+		case <-r.Context().Done():
+		}
+		return false
+	case faultTruncate:
+		rw.truncateAfter = f.TruncateAfter
+		return false
+	case faultStatus:
+		if f.RetryAfter != "" {
+			rw.Header().Set("Retry-After", f.RetryAfter)
+		}
+		typ := "server_error"
+		if f.Status == http.StatusTooManyRequests {
+			typ = "rate_limit_exceeded"
+		}
+		writeError(rw, f.Status, typ, fmt.Sprintf("injected fault: %s", http.StatusText(f.Status)))
+	case faultMalformed:
+		var req struct {
+			Stream bool `json:"stream"`
+		}
+		json.Unmarshal(body, &req)
+		if req.Stream {
+			rw.Header().Set("Content-Type", "text/event-stream")
+			rw.WriteHeader(http.StatusOK)
+			fmt.Fprint(rw, "data: {\"id\":\"chatcmpl-fault\",\"object\":\"chat.completion.chunk\",\"choices\":[{\"delta\":{\"content\":\"\n\ndata: [DONE]\n\n")
+		} else {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusOK)
+			fmt.Fprint(rw, `{"id":"chatcmpl-fault","object":"chat.completion","choices":[{"message":{"role":"assistant","content":"`)
+		}
+	case faultDrop:
+		rw.status = 0
+		rw.abort = true
+	}
+	return true
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Subset of the Gemini generateContent wire format the proxy translates
+// chat completions to and from.
+
+type geminiRequestBody struct {
+	Contents          []*geminiContent        `json:"contents"`
+	SystemInstruction *geminiContent          `json:"systemInstruction,omitempty"`
+	Tools             []*geminiTool           `json:"tools,omitempty"`
+	ToolConfig        *geminiToolConfig       `json:"toolConfig,omitempty"`
+	GenerationConfig  *geminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string        `json:"role,omitempty"`
+	Parts []*geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text string `json:"text,omitempty"`
+	// Thought marks the text as a thought summary, not part of the answer.
+	Thought          bool                    `json:"thought,omitempty"`
+	InlineData       *geminiBlob             `json:"inlineData,omitempty"`
+	FileData         *geminiFile             `json:"fileData,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type geminiFile struct {
+	FileURI string `json:"fileUri"`
+}
+
+type geminiFunctionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type geminiFunctionResponse struct {
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type geminiTool struct {
+	FunctionDeclarations []*geminiFunction `json:"functionDeclarations"`
+}
+
+type geminiFunction struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+type geminiToolConfig struct {
+	FunctionCallingConfig struct {
+		Mode                 string   `json:"mode"`
+		AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+	} `json:"functionCallingConfig"`
+}
+
+type geminiGenerationConfig struct {
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+}
+
+type geminiResponse struct {
+	ResponseID string `json:"responseId"`
+	Candidates []*struct {
+		Content      *geminiContent `json:"content"`
+		FinishReason string         `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata *struct {
+		PromptTokenCount        int64 `json:"promptTokenCount"`
+		CandidatesTokenCount    int64 `json:"candidatesTokenCount"`
+		ThoughtsTokenCount      int64 `json:"thoughtsTokenCount"`
+		CachedContentTokenCount int64 `json:"cachedContentTokenCount"`
+	} `json:"usageMetadata"`
+	ModelVersion string `json:"modelVersion"`
+	// Error is set instead of the rest when a stream fails midway.
+	Error json.RawMessage `json:"error"`
+}
+
+// usage returns the usage in the OpenAI format, where thinking tokens count
+// as completion tokens.
+func (r *geminiResponse) usage() json.RawMessage {
+	u := r.UsageMetadata
+	if u == nil {
+		return nil
+	}
+	return openAIUsage(u.PromptTokenCount, u.CandidatesTokenCount+u.ThoughtsTokenCount, u.CachedContentTokenCount)
+}
+
+// geminiRequest translates a chat completion request into a generateContent
+// request, or a streamGenerateContent one for streams. Gemini names the
+// function a result answers rather than the call, so tool messages are
+// matched to the tool calls that precede them.
+func geminiRequest(chat *chatRequest, key string) (*providerRequest, error) {
+	if chat.Model == "" {
+		return nil, fmt.Errorf("gemini requests need a model")
+	}
+	req := &geminiRequestBody{}
+	gen := &geminiGenerationConfig{
+		Temperature:     chat.Temperature,
+		TopP:            chat.TopP,
+		MaxOutputTokens: max(chat.MaxTokens, chat.MaxCompletionTokens),
+		StopSequences:   chat.StopSequences(),
+	}
+	if gen.Temperature != nil || gen.TopP != nil || gen.MaxOutputTokens > 0 || gen.StopSequences != nil {
+		req.GenerationConfig = gen
+	}
+	functions := map[string]string{}
+	var system []*geminiPart
+	for _, m := range chat.Messages {
+		var parts []*geminiPart
+		role := "user"
+		switch m.Role {
+		case "system", "developer":
+			system = append(system, &geminiPart{Text: m.Text()})
+			continue
+		case "assistant":
+			role = "model"
+			if text := m.Text(); text != "" {
+				parts = append(parts, &geminiPart{Text: text})
+			}
+			for _, call := range m.ToolCalls {
+				functions[call.ID] = call.Function.Name
+				parts = append(parts, &geminiPart{FunctionCall: &geminiFunctionCall{
+					Name: call.Function.Name,
+					Args: toolArguments(call),
+				}})
+			}
+		case "tool":
+			name := functions[m.ToolCallID]
+			if name == "" {
+				name = m.Name
+			}
+			parts = append(parts, &geminiPart{FunctionResponse: &geminiFunctionResponse{
+				Name:     name,
+				Response: map[string]any{"content": m.Text()},
+			}})
+		default:
+			for _, p := range m.Parts() {
+				switch {
+				case p.Type == "text" && p.Text != "":
+					parts = append(parts, &geminiPart{Text: p.Text})
+				case p.Type == "image_url" && p.ImageURL != nil:
+					if mediaType, data, ok := dataURL(p.ImageURL.URL); ok {
+						parts = append(parts, &geminiPart{InlineData: &geminiBlob{MimeType: mediaType, Data: data}})
+					} else {
+						parts = append(parts, &geminiPart{FileData: &geminiFile{FileURI: p.ImageURL.URL}})
+					}
+				}
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		if n := len(req.Contents); n > 0 && req.Contents[n-1].Role == role {
+			req.Contents[n-1].Parts = append(req.Contents[n-1].Parts, parts...)
+			continue
+		}
+		req.Contents = append(req.Contents, &geminiContent{Role: role, Parts: parts})
+	}
+	if len(system) > 0 {
+		req.SystemInstruction = &geminiContent{Parts: system}
+	}
+	if len(chat.Tools) > 0 {
+		tool := &geminiTool{}
+		for _, t := range chat.Tools {
+			var schema map[string]any
+			json.Unmarshal(t.Function.Parameters, &schema)
+			tool.FunctionDeclarations = append(tool.FunctionDeclarations, &geminiFunction{
+				Name:        t.Function.Name,
+				Description: t.Function.Description,
+				Parameters:  geminiSchema(schema),
+			})
+		}
+		req.Tools = []*geminiTool{tool}
+		mode, function := chat.ToolChoiceMode()
+		if mode != "" {
+			req.ToolConfig = &geminiToolConfig{}
+			req.ToolConfig.FunctionCallingConfig.Mode = map[string]string{
+				"none": "NONE", "auto": "AUTO", "required": "ANY",
+			}[mode]
+			if function != "" {
+				req.ToolConfig.FunctionCallingConfig.AllowedFunctionNames = []string{function}
+			}
+		}
+	}
+	pr := &providerRequest{
+		path:   "/v1beta/models/" + url.PathEscape(chat.Model) + ":generateContent",
+		header: http.Header{},
+		body:   req,
+	}
+	if chat.Stream {
+		pr.path, pr.query = "/v1beta/models/"+url.PathEscape(chat.Model)+":streamGenerateContent", "alt=sse"
+	}
+	if key != "" {
+		pr.header.Set("X-Goog-Api-Key", key)
+	}
+	return pr, nil
+}
+
+// geminiSchemaKeys are the JSON schema keywords Gemini function parameters
+// accept; it rejects requests with others, such as additionalProperties.
+var geminiSchemaKeys = map[string]bool{
+	"type": true, "format": true, "title": true, "description": true, "nullable": true,
+	"enum": true, "properties": true, "required": true, "items": true, "anyOf": true,
+	"minItems": true, "maxItems": true, "minimum": true, "maximum": true,
+	"minLength": true, "maxLength": true, "pattern": true, "default": true,
+}
+
+// geminiSchema returns the subset of a JSON schema Gemini understands.
+// Objects without properties are dropped, as Gemini rejects them, along with
+// the properties and required names that refer to them.
+func geminiSchema(schema map[string]any) map[string]any {
+	if schema == nil {
+		return nil
+	}
+	out := map[string]any{}
+	for k, v := range schema {
+		if !geminiSchemaKeys[k] {
+			continue
+		}
+		switch k {
+		case "type":
+			// a list of types, as in ["string", "null"], becomes a
+			// nullable type
+			if types, ok := v.([]any); ok {
+				v = nil
+				for _, t := range types {
+					if t == "null" {
+						out["nullable"] = true
+					} else if v == nil {
+						v = t
+					}
+				}
+			}
+		case "properties":
+			props := map[string]any{}
+			for name, p := range jsonObject(v) {
+				if p := geminiSchema(jsonObject(p)); p != nil {
+					props[name] = p
+				}
+			}
+			v = props
+		case "items":
+			items := geminiSchema(jsonObject(v))
+			v = nil
+			if items != nil {
+				v = items
+			}
+		case "anyOf":
+			var schemas []any
+			list, _ := v.([]any)
+			for _, s := range list {
+				if s := geminiSchema(jsonObject(s)); s != nil {
+					schemas = append(schemas, s)
+				}
+			}
+			v = nil
+			if schemas != nil {
+				v = schemas
+			}
+		}
+		if v != nil {
+			out[k] = v
+		}
+	}
+	if out["type"] == "object" && len(jsonObject(out["properties"])) == 0 {
+		return nil
+	}
+	if list, ok := out["required"].([]any); ok {
+		props := jsonObject(out["properties"])
+		var required []any
+		for _, name := range list {
+			if name, _ := name.(string); props[name] != nil {
+				required = append(required, name)
+			}
+		}
+		delete(out, "required")
+		if required != nil {
+			out["required"] = required
+		}
+	}
+	return out
+}
+
+// geminiFinishReason maps a Gemini finish reason to a finish reason.
+func geminiFinishReason(reason string, toolCalls bool) string {
+	switch reason {
+	case "":
+		return ""
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return "content_filter"
+	}
+	if toolCalls {
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+// message returns the answer of the first candidate as a chat message, and
+// its finish reason. Gemini does not identify function calls, so they are
+// given new IDs.
+func (r *geminiResponse) message(toolIndex int) (*chatMessage, string) {
+	msg := &chatMessage{}
+	if len(r.Candidates) == 0 {
+		return msg, ""
+	}
+	c := r.Candidates[0]
+	if c.Content != nil {
+		for _, p := range c.Content.Parts {
+			switch {
+			case p.FunctionCall != nil:
+				i := toolIndex + len(msg.ToolCalls)
+				id := p.FunctionCall.ID
+				if id == "" {
+					id = "call_" + newRequestID()
+				}
+				args := string(p.FunctionCall.Args)
+				if args == "" {
+					args = "{}"
+				}
+				msg.ToolCalls = append(msg.ToolCalls, &toolCall{
+					Index:    &i,
+					ID:       id,
+					Type:     "function",
+					Function: toolFunction{Name: p.FunctionCall.Name, Arguments: args},
+				})
+			case !p.Thought:
+				msg.Content += p.Text
+			}
+		}
+	}
+	return msg, geminiFinishReason(c.FinishReason, toolIndex+len(msg.ToolCalls) > 0)
+}
+
+// geminiCompletion translates a generateContent response into a chat
+// completion.
+func geminiCompletion(data []byte, model string) (*chatCompletion, error) {
+	var resp geminiResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	msg, finish := resp.message(0)
+	msg.Role = "assistant"
+	for _, call := range msg.ToolCalls {
+		call.Index = nil
+	}
+	if resp.ModelVersion != "" {
+		model = resp.ModelVersion
+	}
+	id := resp.ResponseID
+	if id == "" {
+		id = "chatcmpl-" + newRequestID()
+	}
+	if finish == "" {
+		finish = "stop"
+	}
+	return &chatCompletion{
+		ID:      id,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []*chatChoice{{Message: msg, FinishReason: &finish}},
+		Usage:   resp.usage(),
+	}, nil
+}
+
+// translateGeminiStream translates the events of a streamGenerateContent
+// response, each a partial response, into chat completion chunks. An error
+// event ends the stream without a finish reason, so that clients do not
+// mistake a failed answer for a complete one.
+func translateGeminiStream(r io.Reader, c *chunkWriter) error {
+	var usage json.RawMessage
+	finish := "stop"
+	tools := 0
+	failed := false
+	err := readEvents(r, func(event, data string) error {
+		if failed {
+			return nil
+		}
+		var resp geminiResponse
+		if err := json.Unmarshal([]byte(data), &resp); err != nil {
+			return fmt.Errorf("gemini event: %w", err)
+		}
+		if resp.Error != nil {
+			failed = true
+			return c.Error([]byte(data))
+		}
+		if resp.ResponseID != "" && c.id == "" {
+			c.id = resp.ResponseID
+		}
+		if resp.ModelVersion != "" {
+			c.model = resp.ModelVersion
+		}
+		if u := resp.usage(); u != nil {
+			// usage is cumulative
+			usage = u
+		}
+		msg, reason := resp.message(tools)
+		tools += len(msg.ToolCalls)
+		if reason != "" {
+			finish = reason
+		}
+		if msg.Content == "" && len(msg.ToolCalls) == 0 && c.started {
+			return nil
+		}
+		return c.Delta(msg)
+	})
+	if err != nil || failed {
+		return err
+	}
+	return c.Finish(finish, usage)
+}
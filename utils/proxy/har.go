@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subset of the HAR 1.2 format, see http://www.softwareishard.com/blog/har-12-spec/.
+// Fields prefixed with an underscore are proxy-specific extensions, which
+// HAR allows.
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string      `json:"version"`
+	Creator harCreator  `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+
+	ID       string  `json:"_id"`
+	Upstream string  `json:"_upstream"`
+	Session  string  `json:"_session,omitempty"`
+	Model    string  `json:"_model,omitempty"`
+	Usage    *Usage  `json:"_usage,omitempty"`
+	CostUSD  float64 `json:"_costUsd,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	// Blocked is the time spent queued by the rate limiter.
+	Blocked float64 `json:"blocked"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func newHARFile(entries []*harEntry) *harFile {
+	if entries == nil {
+		entries = []*harEntry{}
+	}
+	return &harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "proxy", Version: "1"},
+		Entries: entries,
+	}}
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	nv := []harNameValue{}
+	for _, name := range sortedKeys(h) {
+		for _, v := range h[name] {
+			nv = append(nv, harNameValue{Name: name, Value: v})
+		}
+	}
+	return nv
+}
+
+// harText turns a decoded body from the traffic log back into text.
+func harText(body json.RawMessage) string {
+	var s string
+	if json.Unmarshal(body, &s) == nil {
+		return s
+	}
+	return string(body)
+}
+
+func harMimeType(h http.Header) string {
+	if ct := h.Get("Content-Type"); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// harEntryFor converts an exchange. Bodies are the decoded ones, with
+// secrets masked; streamed responses are the reassembled completion.
+func harEntryFor(x *Exchange) *harEntry {
+	base := x.Upstream
+	if !strings.Contains(base, "://") {
+		// cassette or mock
+		base = "http://" + base
+	}
+	path := x.UpstreamPath
+	if path == "" {
+		path = x.Path
+	}
+	u := strings.TrimSuffix(base, "/") + path
+	if x.Query != "" {
+		u += "?" + x.Query
+	}
+	query := []harNameValue{}
+	values, _ := url.ParseQuery(x.Query)
+	for _, name := range sortedKeys(values) {
+		for _, v := range values[name] {
+			query = append(query, harNameValue{Name: name, Value: v})
+		}
+	}
+
+	e := &harEntry{
+		StartedDateTime: x.Start,
+		Time:            x.LatencyMS,
+		Request: harRequest{
+			Method:      x.Method,
+			URL:         u,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(x.RequestHeaders),
+			QueryString: query,
+			HeadersSize: -1,
+			BodySize:    x.RequestBytes,
+		},
+		Response: harResponse{
+			Status:      x.Status,
+			StatusText:  http.StatusText(x.Status),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(x.ResponseHeaders),
+			Content: harContent{
+				MimeType: harMimeType(x.ResponseHeaders),
+				Text:     harText(x.Response),
+			},
+			HeadersSize: -1,
+			BodySize:    x.ResponseBytes,
+		},
+		Timings: harTimings{
+			Blocked: x.QueuedMS,
+			Wait:    max(x.LatencyMS-x.QueuedMS, 0),
+		},
+		Comment:  x.Error,
+		ID:       x.ID,
+		Upstream: x.Upstream,
+		Session:  x.Session,
+		Model:    x.Model,
+		Usage:    x.Usage,
+		CostUSD:  x.CostUSD,
+	}
+	e.Response.Content.Size = len(e.Response.Content.Text)
+	if x.Streamed {
+		e.Response.Content.Comment = "event stream reassembled into a single completion"
+	}
+	if len(x.Request) > 0 {
+		e.Request.PostData = &harPostData{
+			MimeType: harMimeType(x.RequestHeaders),
+			Text:     harText(x.Request),
+		}
+	}
+	return e
+}
+
+// harWriter keeps a HAR file up to date with the exchanges proxied so far.
+// HAR is a single JSON document, so each entry is written over the brackets
+// closing the document, which are then written again after it. The file is
+// valid between writes, and neither memory nor the cost of a write grows
+// with the number of entries.
+type harWriter struct {
+	mu sync.Mutex
+	f  *os.File
+	// trailer closes the entries array and the document; it starts at end.
+	trailer []byte
+	end     int64
+	entries int
+}
+
+// harIndent is the indentation of entries in the file.
+const harIndent = "      "
+
+func newHARWriter(path string) (*harWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("write HAR: %w", err)
+	}
+	// split the empty document after the opening bracket of the entries
+	doc, _ := json.MarshalIndent(newHARFile(nil), "", "  ")
+	i := bytes.LastIndex(doc, []byte("[]")) + 1
+	w := &harWriter{f: f, end: int64(i)}
+	w.trailer = fmt.Appendf(nil, "\n    %s\n", doc[i:])
+	if _, err := f.Write(append(doc[:i], w.trailer...)); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("write HAR: %w", err)
+	}
+	return w, nil
+}
+
+func (w *harWriter) Write(x *Exchange) error {
+	entry, err := json.MarshalIndent(harEntryFor(x), harIndent, "  ")
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var buf bytes.Buffer
+	if w.entries > 0 {
+		buf.WriteByte(',')
+	}
+	buf.WriteString("\n" + harIndent)
+	buf.Write(entry)
+	n := int64(buf.Len())
+	buf.Write(w.trailer)
+	if _, err := w.f.WriteAt(buf.Bytes(), w.end); err != nil {
+		return fmt.Errorf("write HAR: %w", err)
+	}
+	w.end += n
+	w.entries++
+	return nil
+}
+
+func (w *harWriter) Close() error {
+	return w.f.Close()
+}
+
+// harCommand implements "proxy har", converting traffic logs to HAR.
+func harCommand(args []string) error {
+	fs := flag.NewFlagSet("proxy har", flag.ContinueOnError)
+	out := fs.String("o", "-", "write the HAR file here instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: proxy har [-o file.har] [traffic.jsonl ...]")
+		fmt.Fprintln(fs.Output(), "Converts traffic logs, or stdin, to HAR 1.2.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var entries []*harEntry
+	collect := func(x *Exchange) error {
+		entries = append(entries, harEntryFor(x))
+		return nil
+	}
+	if fs.NArg() == 0 {
+		if err := readExchanges(os.Stdin, collect); err != nil {
+			return fmt.Errorf("stdin: %w", err)
+		}
+	}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = readExchanges(f, collect)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime.Before(entries[j].StartedDateTime)
+	})
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(newHARFile(entries))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readHAR waits for the HAR file to be valid and hold n entries. The HAR is
+// written after the exchange is logged, and may be read mid-write.
+func readHAR(t *testing.T, path string, n int) *harFile {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var har harFile
+		err = json.Unmarshal(data, &har)
+		if (err == nil && len(har.Log.Entries) >= n) || time.Now().After(deadline) {
+			if err != nil {
+				t.Fatalf("invalid HAR: %v\n%s", err, data)
+			}
+			if len(har.Log.Entries) != n {
+				t.Fatalf("HAR has %d entries, want %d", len(har.Log.Entries), n)
+			}
+			return &har
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHARWriter(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"path":"` + r.URL.Path + `"}`))
+	}))
+	defer upstream.Close()
+	path := filepath.Join(t.TempDir(), "traffic.har")
+	proxyURL, _ := startProxy(t, &Config{
+		Upstream: upstream.URL,
+		Routes:   []Route{{Prefix: "/claude", Upstream: upstream.URL + "/api"}},
+		HAR:      path,
+	})
+	readHAR(t, path, 0)
+
+	want := []string{
+		upstream.URL + "/v1/chat/completions?alt=sse",
+		upstream.URL + "/api/v1/chat/completions",
+	}
+	for i, p := range []string{"/v1/chat/completions?alt=sse", "/claude/v1/chat/completions"} {
+		resp, err := http.Post(proxyURL+p, "application/json", strings.NewReader(`{"model":"gpt-4o"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		har := readHAR(t, path, i+1)
+		if got := har.Log.Entries[i].Request.URL; got != want[i] {
+			t.Errorf("URL = %s, want %s", got, want[i])
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ServerConfig tunes the HTTP server of the proxy. Durations are strings
+// such as "30s"; "0" disables a timeout.
+type ServerConfig struct {
+	// ReadHeaderTimeout bounds the time to read request headers, 10s by
+	// default.
+	ReadHeaderTimeout string `json:"readHeaderTimeout"`
+	// ReadTimeout bounds the time to read a whole request, 1m by default.
+	ReadTimeout string `json:"readTimeout"`
+	// WriteTimeout bounds the time to answer a request, 10m by default.
+	// Streamed responses are exempt once they start, as they last as long
+	// as the completion.
+	WriteTimeout string `json:"writeTimeout"`
+	// IdleTimeout bounds the time keep-alive connections stay open between
+	// requests, 2m by default.
+	IdleTimeout string `json:"idleTimeout"`
+	// ShutdownTimeout is how long in-flight requests, streams included,
+	// may run on after SIGINT or SIGTERM, 30s by default.
+	ShutdownTimeout string `json:"shutdownTimeout"`
+}
+
+// serverTimeouts are the parsed durations of a ServerConfig.
+type serverTimeouts struct {
+	readHeader, read, write, idle, shutdown time.Duration
+}
+
+func (cfg ServerConfig) timeouts() (*serverTimeouts, error) {
+	t := &serverTimeouts{
+		readHeader: 10 * time.Second,
+		read:       time.Minute,
+		write:      10 * time.Minute,
+		idle:       2 * time.Minute,
+		shutdown:   30 * time.Second,
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"readHeaderTimeout", cfg.ReadHeaderTimeout, &t.readHeader},
+		{"readTimeout", cfg.ReadTimeout, &t.read},
+		{"writeTimeout", cfg.WriteTimeout, &t.write},
+		{"idleTimeout", cfg.IdleTimeout, &t.idle},
+		{"shutdownTimeout", cfg.ShutdownTimeout, &t.shutdown},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if d.value == "0" {
+			*d.dst = 0
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("server %s: %w", d.name, err)
+		}
+		*d.dst = v
+	}
+	return t, nil
+}
+
+// httpServer returns the server listening on addr with the timeouts.
+func (t *serverTimeouts) httpServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: t.readHeader,
+		ReadTimeout:       t.read,
+		WriteTimeout:      t.write,
+		IdleTimeout:       t.idle,
+	}
+}
+
+// readyTimeout bounds the upstream checks of /readyz.
+const readyTimeout = 5 * time.Second
+
+// serveHealth answers liveness probes: the proxy is up.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// serveReady answers readiness probes: the proxy is ready when every
+// upstream answers HTTP requests, whatever the status. Replayed and mocked
+// traffic needs no upstream.
+func (s *server) serveReady(w http.ResponseWriter, r *http.Request) {
+	if s.player != nil || s.mock != nil {
+		writeJSON(w, map[string]string{"status": "ready"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	upstreams := map[string]string{}
+	ready := true
+	for _, u := range s.upstreams {
+		target := u.target.String()
+		if _, ok := upstreams[target]; ok {
+			continue
+		}
+		upstreams[target] = ""
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := "ok"
+			if err := s.probe(ctx, target); err != nil {
+				result = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			upstreams[target] = result
+			ready = ready && result == "ok"
+		}()
+	}
+	wg.Wait()
+	status := "ready"
+	if !ready {
+		status = "unavailable"
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, map[string]any{"status": status, "upstreams": upstreams})
+}
+
+// probe checks that the upstream at target answers a HEAD request.
+func (s *server) probe(ctx context.Context, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.prober.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Close waits for the requests still being handled, then flushes and closes
+// the traffic log, the cassette and the span exporter.
+func (s *server) Close(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("requests still in flight: %w", ctx.Err())
+	}
+	err = errors.Join(err, s.traffic.Close())
+	if s.recorder != nil {
+		err = errors.Join(err, s.recorder.Close())
+	}
+	if s.har != nil {
+		err = errors.Join(err, s.har.Close())
+	}
+	return errors.Join(err, s.tracer.Shutdown(ctx))
+}
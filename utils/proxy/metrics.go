@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// latencyBuckets are the histogram buckets, in seconds, for request
+// duration. LLM calls routinely take tens of seconds, hence the long tail.
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300}
+
+// labels renders a Prometheus label set from name/value pairs.
+func labels(kv ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(kv[i+1])
+		fmt.Fprintf(&b, `%s="%s"`, kv[i], v)
+	}
+	return b.String()
+}
+
+// series holds one value per label set.
+type series struct {
+	name, help, typ string
+	values          map[string]float64
+}
+
+func newSeries(name, typ, help string) *series {
+	return &series{name: name, typ: typ, help: help, values: map[string]float64{}}
+}
+
+func (s *series) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.typ)
+	for _, l := range sortedKeys(s.values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", s.name, l, formatFloat(s.values[l]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	buckets    []float64
+	series     map[string]*histogram
+}
+
+func (h *histogramVec) observe(l string, v float64) {
+	hist := h.series[l]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[l] = hist
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, l := range sortedKeys(h.series) {
+		hist := h.series[l]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", h.name, l, formatFloat(le), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, l, hist.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, l, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, l, hist.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metrics exports proxy activity in the Prometheus text format at /metrics.
+type metrics struct {
+	mu            sync.Mutex
+	requests      *series
+	inFlight      *series
+	requestBytes  *series
+	responseBytes *series
+	tokens        *series
+	cost          *series
+	cache         *series
+	duration      *histogramVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:      newSeries("proxy_requests_total", "counter", "Proxied requests by upstream, model and status code."),
+		inFlight:      newSeries("proxy_in_flight_requests", "gauge", "Requests currently being proxied."),
+		requestBytes:  newSeries("proxy_request_bytes_total", "counter", "Request body bytes received from clients."),
+		responseBytes: newSeries("proxy_response_bytes_total", "counter", "Response body bytes sent to clients."),
+		tokens:        newSeries("proxy_tokens_total", "counter", "Tokens reported by the provider, by type."),
+		cost:          newSeries("proxy_cost_usd_total", "counter", "Cost in US dollars according to the pricing table."),
+		cache:         newSeries("proxy_cache_requests_total", "counter", "Requests looked up in the response cache, by result."),
+		duration: &histogramVec{
+			name:    "proxy_request_duration_seconds",
+			help:    "Time from receiving a request to the end of its response.",
+			buckets: latencyBuckets,
+			series:  map[string]*histogram{},
+		},
+	}
+}
+
+// Begin counts a request as in flight until the returned function is called.
+func (m *metrics) Begin(upstream string) func() {
+	l := labels("upstream", upstream)
+	m.mu.Lock()
+	m.inFlight.values[l]++
+	m.mu.Unlock()
+	return func() {
+		m.mu.Lock()
+		m.inFlight.values[l]--
+		m.mu.Unlock()
+	}
+}
+
+func (m *metrics) Observe(x *Exchange) {
+	upstream := x.Upstream
+	l := labels("upstream", upstream, "model", x.Model)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests.values[labels("upstream", upstream, "model", x.Model, "status", strconv.Itoa(x.Status))]++
+	m.requestBytes.values[l] += float64(x.RequestBytes)
+	m.responseBytes.values[l] += float64(x.ResponseBytes)
+	m.duration.observe(l, x.LatencyMS/1000)
+	if x.Cache != "" {
+		m.cache.values[labels("upstream", upstream, "result", x.Cache)]++
+	}
+	if x.Usage != nil {
+		m.tokens.values[labels("upstream", upstream, "model", x.Model, "type", "input")] += float64(x.Usage.InputTokens)
+		m.tokens.values[labels("upstream", upstream, "model", x.Model, "type", "output")] += float64(x.Usage.OutputTokens)
+		m.tokens.values[labels("upstream", upstream, "model", x.Model, "type", "cached_input")] += float64(x.Usage.CachedInputTokens)
+		m.cost.values[l] += x.CostUSD
+	}
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range []*series{m.requests, m.inFlight, m.requestBytes, m.responseBytes, m.tokens, m.cost, m.cache} {
+		s.writeTo(w)
+	}
+	m.duration.writeTo(w)
+}
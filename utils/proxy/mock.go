@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scenario scripts the replies of the mock server. For each chat completion
+// request, the first step whose match conditions all hold is answered.
+type Scenario struct {
+	Steps []*ScenarioStep `json:"steps"`
+}
+
+type ScenarioStep struct {
+	Match MockMatch `json:"match"`
+	Reply MockReply `json:"reply"`
+}
+
+// MockMatch conditions a step on the request. Empty fields always match.
+type MockMatch struct {
+	// Model is the requested model.
+	Model string `json:"model"`
+	// Turn is the number of assistant messages already in the
+	// conversation, so a script can follow a conversation turn by turn.
+	Turn *int `json:"turn"`
+	// LastRole is the role of the last message, e.g. "user" or "tool".
+	LastRole string `json:"lastRole"`
+	// Contains must appear in the content of the last message.
+	Contains string `json:"contains"`
+	// Tool must be among the tools offered by the request.
+	Tool string `json:"tool"`
+}
+
+type MockReply struct {
+	Content   string          `json:"content"`
+	ToolCalls []*MockToolCall `json:"toolCalls"`
+	// Usage is reported as is; when unset, tokens are estimated from the
+	// request and reply sizes.
+	Usage *Usage `json:"usage"`
+}
+
+type MockToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+func loadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read scenario: %w", err)
+	}
+	sc := &Scenario{}
+	if err := json.Unmarshal(data, sc); err != nil {
+		return nil, fmt.Errorf("parse scenario %s: %w", path, err)
+	}
+	return sc, nil
+}
+
+func (m *MockMatch) matches(req *chatRequest) bool {
+	if m.Model != "" && m.Model != req.Model {
+		return false
+	}
+	var last *chatRequestMessage
+	turn := 0
+	for _, msg := range req.Messages {
+		if msg.Role == "assistant" {
+			turn++
+		}
+		last = msg
+	}
+	if m.Turn != nil && *m.Turn != turn {
+		return false
+	}
+	if m.LastRole != "" && (last == nil || last.Role != m.LastRole) {
+		return false
+	}
+	if m.Contains != "" && (last == nil || !strings.Contains(last.Text(), m.Contains)) {
+		return false
+	}
+	if m.Tool != "" {
+		found := false
+		for _, tool := range req.Tools {
+			found = found || tool.Function.Name == m.Tool
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// mockServer is an OpenAI-compatible chat completions endpoint answering
+// from a scenario, for evals on machines without network.
+type mockServer struct {
+	scenario *Scenario
+
+	mu sync.Mutex
+	// seq numbers completions and tool calls so that their IDs are stable
+	// from one run to the next.
+	seq int
+}
+
+func (m *mockServer) next() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	return m.seq
+}
+
+// Serve answers a request from the scenario. It reports whether a step
+// matched.
+func (m *mockServer) Serve(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/chat/completions") {
+		writeError(w, http.StatusNotFound, "mock_not_found",
+			fmt.Sprintf("the mock server only serves chat completions, not %s %s", r.Method, r.URL.Path))
+		return false
+	}
+	req := &chatRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "invalid JSON body: "+err.Error())
+		return false
+	}
+	var step *ScenarioStep
+	for _, s := range m.scenario.Steps {
+		if s.Match.matches(req) {
+			step = s
+			break
+		}
+	}
+	if step == nil {
+		writeMiss(w, "mock_no_match", "no scenario step matches this request")
+		return false
+	}
+
+	n := m.next()
+	msg := &chatMessage{Role: "assistant", Content: step.Reply.Content}
+	for i, tc := range step.Reply.ToolCalls {
+		args := string(tc.Arguments)
+		if args == "" {
+			args = "{}"
+		}
+		msg.ToolCalls = append(msg.ToolCalls, &toolCall{
+			ID:       fmt.Sprintf("call_mock_%d_%d", n, i),
+			Type:     "function",
+			Function: toolFunction{Name: tc.Name, Arguments: args},
+		})
+	}
+	finish := "stop"
+	if len(msg.ToolCalls) > 0 {
+		finish = "tool_calls"
+	}
+	usage := step.Reply.Usage
+	if usage == nil {
+		// roughly four bytes per token
+		out, _ := json.Marshal(msg)
+		usage = &Usage{InputTokens: int64(len(body) / 4), OutputTokens: int64(len(out) / 4)}
+	}
+	usageJSON, _ := json.Marshal(map[string]int64{
+		"prompt_tokens":     usage.InputTokens,
+		"completion_tokens": usage.OutputTokens,
+		"total_tokens":      usage.InputTokens + usage.OutputTokens,
+	})
+	completion := &chatCompletion{
+		ID:      fmt.Sprintf("chatcmpl-mock-%d", n),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []*chatChoice{{Message: msg, FinishReason: &finish}},
+		Usage:   usageJSON,
+	}
+	if req.Stream {
+		includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+		writeCompletionStream(w, completion, includeUsage)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(completion)
+	}
+	return true
+}
+
+// writeCompletionStream sends a completion as a stream of chunks, the way
+// OpenAI does: the role first, then content a word at a time, then each tool
+// call's name followed by its arguments, then the finish reason.
+func writeCompletionStream(w http.ResponseWriter, c *chatCompletion, includeUsage bool) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	chunk := func(delta *chatMessage, finish *string) {
+		writeEvent(w, &chatCompletion{
+			ID:      c.ID,
+			Object:  "chat.completion.chunk",
+			Created: c.Created,
+			Model:   c.Model,
+			Choices: []*chatChoice{{Delta: delta, FinishReason: finish}},
+		})
+	}
+	for _, choice := range c.Choices {
+		msg := choice.Message
+		chunk(&chatMessage{Role: msg.Role}, nil)
+		for _, word := range strings.SplitAfter(msg.Content, " ") {
+			if word != "" {
+				chunk(&chatMessage{Content: word}, nil)
+			}
+		}
+		for i, tc := range msg.ToolCalls {
+			chunk(&chatMessage{ToolCalls: []*toolCall{{
+				Index: &i, ID: tc.ID, Type: tc.Type,
+				Function: toolFunction{Name: tc.Function.Name},
+			}}}, nil)
+			chunk(&chatMessage{ToolCalls: []*toolCall{{
+				Index:    &i,
+				Function: toolFunction{Arguments: tc.Function.Arguments},
+			}}}, nil)
+		}
+		chunk(&chatMessage{}, choice.FinishReason)
+	}
+	if includeUsage {
+		writeEvent(w, &chatCompletion{
+			ID:      c.ID,
+			Object:  "chat.completion.chunk",
+			Created: c.Created,
+			Model:   c.Model,
+			Choices: []*chatChoice{},
+			Usage:   c.Usage,
+		})
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	http.NewResponseController(w).Flush()
+}
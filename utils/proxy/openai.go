@@ -0,0 +1,137 @@
+package main
+
+import "encoding/json"
+
+// Subset of the OpenAI chat-completions wire format the proxy needs to
+// understand. Unknown fields are ignored.
+
+type chatCompletion struct {
+	ID      string          `json:"id,omitempty"`
+	Object  string          `json:"object,omitempty"`
+	Created int64           `json:"created,omitempty"`
+	Model   string          `json:"model,omitempty"`
+	Choices []*chatChoice   `json:"choices"`
+	Usage   json.RawMessage `json:"usage,omitempty"`
+}
+
+type chatChoice struct {
+	Index        int          `json:"index"`
+	Message      *chatMessage `json:"message,omitempty"`
+	Delta        *chatMessage `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type chatMessage struct {
+	Role      string      `json:"role,omitempty"`
+	Content   string      `json:"content,omitempty"`
+	ToolCalls []*toolCall `json:"tool_calls,omitempty"`
+}
+
+type toolCall struct {
+	// Index identifies the tool call a streamed delta belongs to.
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
+	Function toolFunction `json:"function"`
+}
+
+type toolFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+type chatRequest struct {
+	Model         string                `json:"model"`
+	Messages      []*chatRequestMessage `json:"messages"`
+	Tools         []*chatTool           `json:"tools,omitempty"`
+	Stream        bool                  `json:"stream,omitempty"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options,omitempty"`
+	MaxTokens           int      `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int      `json:"max_completion_tokens,omitempty"`
+	Temperature         *float64 `json:"temperature,omitempty"`
+	TopP                *float64 `json:"top_p,omitempty"`
+	// Stop is a string or an array of strings.
+	Stop json.RawMessage `json:"stop,omitempty"`
+	// ToolChoice is "none", "auto", "required" or a named function.
+	ToolChoice json.RawMessage `json:"tool_choice,omitempty"`
+}
+
+// StopSequences returns the stop sequences of the request.
+func (r *chatRequest) StopSequences() []string {
+	var stop []string
+	if json.Unmarshal(r.Stop, &stop) != nil {
+		var s string
+		if json.Unmarshal(r.Stop, &s) == nil && s != "" {
+			stop = []string{s}
+		}
+	}
+	return stop
+}
+
+// ToolChoiceMode returns the tool choice of the request, "none", "auto" or
+// "required", and the function it names if any, which implies "required".
+func (r *chatRequest) ToolChoiceMode() (mode, function string) {
+	if json.Unmarshal(r.ToolChoice, &mode) == nil {
+		return mode, ""
+	}
+	var named struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if json.Unmarshal(r.ToolChoice, &named) == nil && named.Function.Name != "" {
+		return "required", named.Function.Name
+	}
+	return "", ""
+}
+
+// chatRequestMessage is a message sent by the client, whose content is
+// either a string or an array of content parts.
+type chatRequestMessage struct {
+	Role       string          `json:"role"`
+	Content    json.RawMessage `json:"content,omitempty"`
+	ToolCalls  []*toolCall     `json:"tool_calls,omitempty"`
+	ToolCallID string          `json:"tool_call_id,omitempty"`
+	Name       string          `json:"name,omitempty"`
+}
+
+// contentPart is an element of the content array of a message.
+type contentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		// URL is a web URL or a base64 data URL.
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+}
+
+// Parts returns the content of the message as content parts.
+func (m *chatRequestMessage) Parts() []*contentPart {
+	var s string
+	if json.Unmarshal(m.Content, &s) == nil {
+		return []*contentPart{{Type: "text", Text: s}}
+	}
+	var parts []*contentPart
+	json.Unmarshal(m.Content, &parts)
+	return parts
+}
+
+// Text returns the textual content of the message.
+func (m *chatRequestMessage) Text() string {
+	var text string
+	for _, p := range m.Parts() {
+		text += p.Text
+	}
+	return text
+}
+
+type chatTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	} `json:"function"`
+}
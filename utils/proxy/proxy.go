@@ -2,24 +2,31 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
-
-	"github.com/andybalholm/brotli"
+	"syscall"
+	"time"
 )
 
-// target is the backend server to which requests will be proxied.
-const target = "https://api.openai.com"
-
-
 type teeReader struct {
 	rc io.ReadCloser
-	w io.Writer
+	w  io.Writer
 }
 
 func (tr teeReader) Read(p []byte) (int, error) {
@@ -37,63 +44,731 @@ func (tr teeReader) Close() error {
 type responseWriter struct {
 	once sync.Once
 	http.ResponseWriter
-	io.Writer
-	newReader func([]byte) io.Reader
+	status int
+	// raw, when set, receives the response body as sent to the client.
+	raw *bytes.Buffer
+	// err is the error that kept the upstream from answering, if any.
+	err error
+	// written counts the body bytes sent to the client.
+	written int64
+	// truncateAfter, when set, cuts the body off after that many bytes and
+	// aborts the connection, to simulate a broken stream.
+	truncateAfter int64
+	// abort drops the connection once the exchange has been logged.
+	abort bool
+
+	body    *bodyDecoder
+	decoded bytes.Buffer
+	events  *sseAssembler
+	// undecodable is the Content-Encoding of a body the proxy cannot
+	// decode, if any.
+	undecodable string
 }
 
 func (rw *responseWriter) WriteHeader(statusCode int) {
-	//log.Println("\nWriting header", rw.ResponseWriter.Header())
+	rw.status = statusCode
 	rw.ResponseWriter.WriteHeader(statusCode)
 }
 
 func (rw *responseWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if rw.truncateAfter > 0 {
+		if rw.abort {
+			return n, nil
+		}
+		if rw.written+int64(len(p)) >= rw.truncateAfter {
+			p = p[:rw.truncateAfter-rw.written]
+			rw.abort = true
+		}
+	}
 	rw.once.Do(func() {
-		rw.Writer.Write([]byte("\nResponse:\n"))
-	})
-	p2 := p
-	if rw.newReader != nil {
-		r := rw.newReader(p)
-		io.Copy(rw.Writer, r)
-		if rc, ok := r.(io.Closer); ok {
-			rc.Close()
+		var sink io.Writer = &rw.decoded
+		if isEventStream(rw.Header()) {
+			// log whole messages rather than a stream of deltas
+			rw.events = &sseAssembler{}
+			sink = rw.events
+			// streams last as long as the completion, whatever the write
+			// timeout
+			http.NewResponseController(rw.ResponseWriter).SetWriteDeadline(time.Time{})
+		}
+		decode, err := decoderFor(rw.Header().Get("Content-Encoding"))
+		if err != nil {
+			log.Printf("could not decode response: %v", err)
+			sink = io.Discard
+			rw.undecodable = rw.Header().Get("Content-Encoding")
 		}
-	} else if _, err := rw.Writer.Write(p2); err != nil {
-		log.Printf("\ncould not write %q", p)
+		rw.body = newBodyDecoder(sink, decode)
+	})
+	rw.body.Write(p)
+	if rw.raw != nil {
+		rw.raw.Write(p)
+	}
+	written, err := rw.ResponseWriter.Write(p)
+	rw.written += int64(written)
+	if rw.abort {
+		rw.Flush()
+		// pretend the rest was written: the connection is dropped once the
+		// upstream response is done
+		return n, nil
 	}
-	return rw.ResponseWriter.Write(p)
+	return written, err
 }
 
-func main() {
+// Flush sends buffered data to the client, so that streamed completions
+// reach it as they are produced.
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Decoded finishes decoding the response body and returns it for the log,
+// along with whether it was streamed. Streamed messages are reassembled.
+func (rw *responseWriter) Decoded() (json.RawMessage, bool) {
+	if rw.body == nil {
+		return nil, false
+	}
+	if err := rw.body.Close(); err != nil {
+		log.Printf("could not decode response: %v", err)
+	}
+	if rw.undecodable != "" {
+		return undecodableBody(rw.undecodable, rw.written), rw.events != nil
+	}
+	if rw.events == nil {
+		return bodyJSON(rw.decoded.Bytes()), false
+	}
+	out, err := json.Marshal(rw.events.Result())
+	if err != nil {
+		log.Printf("could not encode streamed response: %v", err)
+		return nil, true
+	}
+	return out, true
+}
+
+// readRequestBody buffers the request body, which is needed to match and
+// record exchanges, and decodes it for the log. A body the proxy cannot
+// decode is returned as is.
+func readRequestBody(r *http.Request) (raw, decoded []byte, err error) {
+	decode, err := decoderFor(r.Header.Get("Content-Encoding"))
+	if err != nil {
+		log.Printf("could not decode request: %v", err)
+	}
+	var buf bytes.Buffer
+	d := newBodyDecoder(&buf, decode)
+	raw, err = io.ReadAll(teeReader{r.Body, d})
+	if err := d.Close(); err != nil {
+		log.Printf("could not decode request: %v", err)
+	}
+	return raw, buf.Bytes(), err
+}
+
+// upstream is a backend server along with the path prefix routed to it.
+type upstream struct {
+	prefix string
+	target *url.URL
+	// provider is the wire format chat completions are translated to, if
+	// not OpenAI's.
+	provider string
+	// credential replaces the API key of the client, if set.
+	credential string
+	proxy      *httputil.ReverseProxy
+}
+
+func newUpstream(prefix, target, provider, credential string, transport http.RoundTripper) (*upstream, error) {
+	if !validProvider(provider) {
+		return nil, fmt.Errorf("upstream %q: unknown provider %q", target, provider)
+	}
 	// Parse the target URL.
 	targetURL, err := url.Parse(target)
 	if err != nil {
-		log.Fatalf("\nFailed to parse target URL: %v", err)
+		return nil, fmt.Errorf("parse upstream %q: %w", target, err)
 	}
+	if targetURL.Scheme == "" || targetURL.Host == "" {
+		return nil, fmt.Errorf("upstream %q must be an absolute URL", target)
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
 
 	// Create the reverse proxy.
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	proxy.Transport = newTranslator(provider, transport)
 
-	// Customize the director to preserve the original request path and query
+	// Customize the director to strip the route prefix and preserve the rest
+	// of the original request path and query
 	originalDirector := proxy.Director
+	u := &upstream{prefix: prefix, target: targetURL, provider: provider, credential: credential, proxy: proxy}
 	proxy.Director = func(req *http.Request) {
+		if prefix != "" {
+			req.URL.Path = u.strip(req.URL.Path)
+			req.URL.RawPath = ""
+		}
 		originalDirector(req)
 		req.URL.Scheme = targetURL.Scheme
 		req.URL.Host = targetURL.Host
 		req.Host = targetURL.Host // optional, depending on backend expectations
 	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		if rw, ok := w.(*responseWriter); ok {
+			rw.err = err
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return u, nil
+}
+
+func (u *upstream) matches(path string) bool {
+	return u.prefix == "" || path == u.prefix || strings.HasPrefix(path, u.prefix+"/")
+}
 
-	// Handle all incoming requests with the proxy.
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("\nProxying request: %s %s", r.Method, r.URL)
-		r.Body = teeReader{r.Body, os.Stdout}
-		proxy.ServeHTTP(&responseWriter{ResponseWriter: w, Writer: os.Stderr, newReader: func(p []byte) io.Reader {
-			return brotli.NewReader(bytes.NewReader(p))
-		}}, r)
+// strip returns a request path without the route prefix.
+func (u *upstream) strip(path string) string {
+	if u.prefix == "" {
+		return path
+	}
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(path, u.prefix), "/")
+}
+
+// server routes each request to the upstream with the longest matching
+// prefix, falling back to the default upstream.
+type server struct {
+	upstreams []*upstream
+	traffic   *trafficLog
+	redact    *redactor
+	stats     *stats
+	metrics   *metrics
+	pricing   pricing
+	// sessionHeader names the request header carrying the session.
+	sessionHeader string
+	// vault authenticates clients, when proxy tokens are configured.
+	vault    *vault
+	recorder *cassetteRecorder
+	player   *cassettePlayer
+	mock     *mockServer
+	faults   *faultInjector
+	limiter  *rateLimiter
+	budgets  *budgets
+	cache    *responseCache
+	har      *harWriter
+	store    *exchangeStore
+	tracer   *tracer
+	rewriter *rewriter
+	// prober checks that upstreams are reachable for /readyz.
+	prober *http.Client
+	// inflight counts the requests being handled, waited for on shutdown.
+	inflight sync.WaitGroup
+}
+
+func newServer(cfg *Config) (*server, error) {
+	s := &server{}
+	var err error
+	// upstream credentials are masked wherever they could be echoed
+	routes := append([]Route{{Upstream: cfg.Upstream, Provider: cfg.Provider, Credential: cfg.Credential}}, cfg.Routes...)
+	credentials := make([]string, len(routes))
+	patterns := cfg.Redact.Patterns
+	for i, route := range routes {
+		if credentials[i], err = resolveCredential(route.Credential); err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", route.Upstream, err)
+		}
+		if credentials[i] != "" {
+			patterns = append(patterns, regexp.QuoteMeta(credentials[i]))
+		}
+	}
+	if s.redact, err = newRedactor(cfg.Redact.Headers, patterns); err != nil {
+		return nil, err
+	}
+	if s.vault, err = newVault(cfg.Vault); err != nil {
+		return nil, err
+	}
+	transport, err := cfg.upstreamTransport()
+	if err != nil {
+		return nil, err
+	}
+	s.prober = &http.Client{
+		Transport: transport,
+		Timeout:   readyTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if transport, err = newRetryTransport(transport, cfg.Retry, s.redact); err != nil {
+		return nil, err
+	}
+	for i, route := range cfg.Routes {
+		if !strings.HasPrefix(route.Prefix, "/") || route.Prefix == "/" {
+			return nil, fmt.Errorf("route prefix %q must start with / and not be the root", route.Prefix)
+		}
+		u, err := newUpstream(route.Prefix, route.Upstream, route.Provider, credentials[i+1], transport)
+		if err != nil {
+			return nil, err
+		}
+		s.upstreams = append(s.upstreams, u)
+	}
+	sort.SliceStable(s.upstreams, func(i, j int) bool {
+		return len(s.upstreams[i].prefix) > len(s.upstreams[j].prefix)
 	})
+	fallback, err := newUpstream("", cfg.Upstream, cfg.Provider, credentials[0], transport)
+	if err != nil {
+		return nil, err
+	}
+	s.upstreams = append(s.upstreams, fallback)
+
+	s.stats = newStats()
+	s.metrics = newMetrics()
+	s.sessionHeader = cfg.SessionHeader
+	if s.pricing, err = loadPricing(cfg.Pricing); err != nil {
+		return nil, err
+	}
+	s.store = newExchangeStore(cfg.Log, cfg.UIMemoryMB)
+	if s.traffic, err = openTrafficLog(cfg.Log); err != nil {
+		return nil, err
+	}
+	if cfg.Record != "" {
+		if s.recorder, err = newCassetteRecorder(cfg.Record); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Replay != "" {
+		if s.player, err = loadCassette(cfg.Replay); err != nil {
+			return nil, err
+		}
+	}
+	if s.rewriter, err = newRewriter(cfg.Rewrites); err != nil {
+		return nil, err
+	}
+	if s.tracer, err = newTracer(cfg.Tracing); err != nil {
+		return nil, err
+	}
+	if cfg.HAR != "" {
+		if s.har, err = newHARWriter(cfg.HAR); err != nil {
+			return nil, err
+		}
+	}
+	if s.cache, err = newResponseCache(cfg.Cache); err != nil {
+		return nil, err
+	}
+	if s.limiter, err = newRateLimiter(cfg.RateLimit); err != nil {
+		return nil, err
+	}
+	s.budgets = newBudgets(cfg.Budget)
+	if s.budgets != nil && s.pricing == nil && (cfg.Budget.Global.CostUSD > 0 || cfg.Budget.Session.CostUSD > 0) {
+		return nil, errors.New("dollar budgets need a pricing table")
+	}
+	if s.faults, err = newFaultInjector(cfg.Faults); err != nil {
+		return nil, err
+	}
+	if cfg.Mock != "" {
+		scenario, err := loadScenario(cfg.Mock)
+		if err != nil {
+			return nil, err
+		}
+		s.mock = &mockServer{scenario: scenario}
+	}
+	return s, nil
+}
+
+func (s *server) route(path string) *upstream {
+	for _, u := range s.upstreams {
+		if u.matches(path) {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.inflight.Add(1)
+	defer s.inflight.Done()
+	session, trace := correlate(r, s.sessionHeader)
+	x := &Exchange{
+		ID:             newRequestID(),
+		Start:          time.Now(),
+		Method:         r.Method,
+		Path:           r.URL.Path,
+		Query:          s.redact.Query(r.URL.RawQuery),
+		RequestHeaders: s.redact.Header(r.Header),
+		Client:         clientID(r),
+		Session:        session,
+		Trace:          trace,
+	}
+	w.Header().Set(requestIDHeader, x.ID)
+	r, span := s.tracer.Start(r)
+
+	u := s.route(r.URL.Path)
+	switch {
+	case s.player != nil:
+		x.Upstream = "cassette"
+	case s.mock != nil:
+		x.Upstream = "mock"
+	default:
+		x.Upstream = u.target.String()
+		x.UpstreamPath = u.strip(r.URL.Path)
+	}
+	log.Printf("%s: %s %s -> %s", x.ID, r.Method, s.redact.URL(r.URL), x.Upstream)
+	defer s.metrics.Begin(x.Upstream)()
+
+	keyID, keyLimit := apiKeyID(r), (*RateLimit)(nil)
+	if s.vault != nil {
+		token, err := s.vault.Authenticate(r)
+		if authErr := (*authError)(nil); errors.As(err, &authErr) {
+			log.Printf("%s: %v", x.ID, err)
+			writeUnauthorized(w, authErr)
+			return
+		}
+		// the token names the client, whatever it claims
+		x.Client, keyID, keyLimit = token.Name, token.Name, token.RateLimit
+	}
+	if s.vault != nil || u.credential != "" {
+		injectCredential(r, u.credential)
+	}
+
+	body, decoded, err := readRequestBody(r)
+	if err != nil {
+		http.Error(w, "read request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rewritten, rules, rewriteErr := s.rewriter.Apply(r, decoded)
+	if rewriteErr != nil {
+		log.Printf("%s: %v", x.ID, rewriteErr)
+		x.Error = rewriteErr.Error()
+	} else if rules != nil {
+		// the rewritten body is sent decoded
+		body, decoded = rewritten, rewritten
+		r.Header.Del("Content-Encoding")
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		r.ContentLength = int64(len(body))
+		x.Rewrites = rules
+		log.Printf("%s: rewritten by %s", x.ID, strings.Join(rules, ", "))
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r = r.WithContext(withRetries(r.Context(), &x.Retries))
+	if _, err := decoderFor(r.Header.Get("Content-Encoding")); err != nil {
+		x.Request = undecodableBody(r.Header.Get("Content-Encoding"), int64(len(body)))
+	} else {
+		x.Request = s.redact.JSON(bodyJSON(decoded))
+	}
+	x.RequestBytes = int64(len(body))
+
+	rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+	var res *reservation
+	var cacheKey string
+	answered := false
+	if rewriteErr != nil {
+		// the request is not sent without the changes its rules make,
+		// such as a pinned model or removed tools
+		writeError(rw, http.StatusBadRequest, "invalid_request_error", rewriteErr.Error())
+		answered = true
+	} else if fault := s.faults.Pick(r, requestModel(decoded)); fault != nil {
+		x.Fault = fault.String()
+		log.Printf("%s: injecting fault: %s", x.ID, x.Fault)
+		answered = fault.Inject(rw, r, decoded)
+	}
+	switch {
+	case answered:
+	case s.player != nil:
+		if !s.player.Replay(rw, r, []byte(s.redact.String(string(decoded)))) {
+			x.Error = "no recorded response"
+		}
+	case s.mock != nil:
+		if !s.mock.Serve(rw, r, decoded) {
+			x.Error = "no matching scenario step"
+		}
+	case s.cache != nil && s.serveCached(x, rw, r, decoded, &cacheKey):
+	default:
+		if err := s.budgets.Check(x.Session); err != nil {
+			x.Error = err.Error()
+			log.Printf("%s: %v", x.ID, err)
+			writeBudgetExceeded(rw, err.(*budgetError))
+			break
+		}
+		var queued time.Duration
+		res, queued, err = s.limiter.Acquire(r.Context(), x.Upstream, keyID, keyLimit, estimateTokens(decoded))
+		x.QueuedMS = float64(queued.Microseconds()) / 1000
+		if rlErr := (*rateLimitError)(nil); errors.As(err, &rlErr) {
+			x.Error = err.Error()
+			writeRateLimited(rw, rlErr)
+			break
+		} else if err != nil {
+			// the client went away while queued
+			x.Error = err.Error()
+			rw.status = 0
+			break
+		}
+		if err := s.budgets.Admit(x.Session); err != nil {
+			// a budget was spent while the request was queued; give its
+			// estimated tokens back to the rate limiter
+			res.Settle(&Usage{})
+			res = nil
+			x.Error = err.Error()
+			log.Printf("%s: %v", x.ID, err)
+			writeBudgetExceeded(rw, err.(*budgetError))
+			break
+		}
+		if s.recorder != nil || cacheKey != "" {
+			rw.raw = &bytes.Buffer{}
+		}
+		u.proxy.ServeHTTP(rw, r)
+		in := &Interaction{
+			Method:  x.Method,
+			Path:    x.Path,
+			Request: s.redact.String(string(decoded)),
+			Status:  rw.status,
+			// cassettes and cache entries are logs too, but are also
+			// served again
+			Header: s.redact.Stored(w.Header()),
+		}
+		// the proxy's own headers describe this exchange, not the ones
+		// served from the recording
+		in.Header.Del(requestIDHeader)
+		in.Header.Del(cacheHeader)
+		if rw.raw != nil {
+			in.Body = rw.raw.Bytes()
+		}
+		if s.recorder != nil {
+			if err := s.recorder.Record(in); err != nil {
+				log.Printf("%s: failed to record exchange: %v", x.ID, err)
+			}
+		}
+		// only complete, successful responses are cached
+		if cacheKey != "" && rw.status == http.StatusOK && rw.err == nil && !rw.abort && rw.truncateAfter == 0 {
+			if err := s.cache.Store(cacheKey, in); err != nil {
+				log.Printf("%s: failed to cache response: %v", x.ID, err)
+			}
+		}
+	}
+
+	x.Response, x.Streamed = rw.Decoded()
+	x.Response = s.redact.JSON(x.Response)
+	x.End = time.Now()
+	x.LatencyMS = float64(x.End.Sub(x.Start).Microseconds()) / 1000
+	x.Status = rw.status
+	x.ResponseBytes = rw.written
+	x.ResponseHeaders = s.redact.Header(w.Header())
+	if rw.err != nil {
+		x.Error = s.redact.Error(rw.err)
+		log.Printf("%s: upstream %s: %s", x.ID, u.target, x.Error)
+	}
+	s.account(x)
+	res.Settle(x.Usage)
+	if res != nil {
+		// the request went upstream
+		s.budgets.Charge(x)
+	}
+	s.metrics.Observe(x)
+	s.tracer.End(span, x)
+	log.Printf("%s: %d in %.0fms", x.ID, x.Status, x.LatencyMS)
+	if err := s.traffic.Write(x); err != nil {
+		log.Printf("%s: failed to log exchange: %v", x.ID, err)
+	}
+	s.store.Add(x)
+	if s.har != nil {
+		if err := s.har.Write(x); err != nil {
+			log.Printf("%s: %v", x.ID, err)
+		}
+	}
+	if rw.abort {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// account records the model, token usage and cost of an exchange and adds
+// them to the running totals.
+func (s *server) account(x *Exchange) {
+	model, usage, ok := parseUsage(x.Response)
+	if model == "" {
+		model = requestModel(x.Request)
+	}
+	x.Model = model
+	if ok {
+		x.Usage = &usage
+		x.CostUSD, x.Priced = s.pricing.Cost(model, usage)
+		if x.Cache == cacheHit {
+			// the provider is not billed for cached responses
+			x.CostUSD = 0
+		}
+	}
+	s.stats.Add(x)
+}
+
+// serveCached answers a request from the response cache. It reports
+// whether the request was answered; on a miss, it sets the key under which
+// to store the response, unless the client bypassed the cache.
+func (s *server) serveCached(x *Exchange, rw *responseWriter, r *http.Request, body []byte, key *string) bool {
+	read, store := s.cache.Mode(r)
+	// with proxy tokens, the client is authenticated and its responses are
+	// kept from the other clients
+	var tenant string
+	if s.vault != nil {
+		tenant = x.Client
+	}
+	k := s.cache.Key(tenant, x.Upstream, r.Method, r.URL.Path, body)
+	switch {
+	case !read && !store:
+		x.Cache = cacheBypass
+	case read:
+		if e, ok := s.cache.Lookup(k); ok {
+			x.Cache = cacheHit
+			s.cache.Count(x.Cache)
+			e.Serve(rw)
+			return true
+		}
+		fallthrough
+	default:
+		x.Cache = cacheMiss
+		*key = k
+	}
+	s.cache.Count(x.Cache)
+	rw.Header().Set(cacheHeader, x.Cache)
+	return false
+}
+
+// mux routes the proxy's own endpoints, and all other requests to the
+// proxy.
+func (s *server) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/", s)
+	// the traffic and totals of all clients are for admins only
+	mux.Handle("/_proxy/stats", s.vault.admin(http.HandlerFunc(s.serveStats)))
+	mux.Handle("/metrics", s.vault.admin(s.metrics))
+	mux.Handle("GET /_proxy/ui", s.vault.admin(http.HandlerFunc(serveUI)))
+	mux.Handle("GET /_proxy/api/exchanges", s.vault.admin(http.HandlerFunc(s.store.serveList)))
+	mux.Handle("GET /_proxy/api/exchanges/{id}", s.vault.admin(http.HandlerFunc(s.store.serveExchange)))
+
+	mux.HandleFunc("GET /healthz", serveHealth)
+	mux.HandleFunc("GET /readyz", s.serveReady)
+	return mux
+}
+
+// serveStats serves the running totals, rate limiter and budget state as
+// JSON.
+func (s *server) serveStats(w http.ResponseWriter, r *http.Request) {
+	snapshot := s.stats.Snapshot()
+	snapshot["rateLimits"] = s.limiter.Snapshot()
+	if s.cache != nil {
+		snapshot["cache"] = s.cache.Snapshot()
+	}
+	if s.budgets != nil {
+		snapshot["budgets"] = s.budgets.Snapshot()
+	}
+	writeJSON(w, snapshot)
+}
+
+// clientID identifies the caller of a request.
+func clientID(r *http.Request) string {
+	if c := r.Header.Get("X-Proxy-Client"); c != "" {
+		return c
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		if err := tokenCommand(os.Args[2:]); err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				log.Fatal(err)
+			}
+			os.Exit(2)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		if err := diffCommand(os.Args[2:]); err != nil {
+			switch {
+			case errors.Is(err, flag.ErrHelp):
+				os.Exit(2)
+			case errors.Is(err, errDiverged):
+				os.Exit(1)
+			}
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "har" {
+		if err := harCommand(os.Args[2:]); err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				log.Fatal(err)
+			}
+			os.Exit(2)
+		}
+		return
+	}
+
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("\nInvalid configuration: %v", err)
+	}
+
+	s, err := newServer(cfg)
+	if err != nil {
+		log.Fatalf("\nFailed to set up upstreams: %v", err)
+	}
+	for _, u := range s.upstreams {
+		prefix := u.prefix
+		if prefix == "" {
+			prefix = "/"
+		}
+		if u.provider != "" && u.provider != providerOpenAI {
+			log.Printf("Routing %s to %s, translating chat completions to %s", prefix, u.target, u.provider)
+			continue
+		}
+		log.Printf("Routing %s to %s", prefix, u.target)
+	}
+	if s.vault != nil {
+		log.Printf("Clients must authenticate with a proxy token")
+	} else {
+		for _, u := range s.upstreams {
+			if u.credential != "" {
+				log.Printf("Warning: the credential of %s is sent on behalf of any client, set proxy tokens to authenticate them", u.target)
+			}
+		}
+	}
+
+	timeouts, err := cfg.Server.timeouts()
+	if err != nil {
+		log.Fatalf("\nInvalid configuration: %v", err)
+	}
+	srv := timeouts.httpServer(cfg.Listen, s.mux())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Start the proxy server.
-	log.Println("Starting proxy server on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	errc := make(chan error, 1)
+	go func() {
+		if cfg.TLS.CertFile != "" {
+			log.Printf("Starting proxy server on %s (TLS)", cfg.Listen)
+			errc <- srv.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		} else {
+			log.Printf("Starting proxy server on %s", cfg.Listen)
+			errc <- srv.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-errc:
 		log.Fatalf("Server failed: %v", err)
+	case <-ctx.Done():
+	}
+	// a second signal kills the proxy right away
+	stop()
+
+	// Stop accepting requests and let the in-flight ones, streams included,
+	// finish before flushing the logs.
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", timeouts.shutdown)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeouts.shutdown)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown: %v, closing the remaining connections", err)
+		srv.Close()
+	}
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelClose()
+	if err := s.Close(closeCtx); err != nil {
+		log.Printf("Shutdown: %v", err)
 	}
+	log.Printf("Proxy stopped")
 }
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimit is a budget of requests and tokens per minute. Zero means
+// unlimited.
+type RateLimit struct {
+	RequestsPerMinute float64 `json:"requestsPerMinute"`
+	TokensPerMinute   float64 `json:"tokensPerMinute"`
+}
+
+// RateLimitConfig limits the traffic sent to each upstream and on behalf of
+// each API key. Requests over budget wait in a queue; they are rejected with
+// a 429 when the queue is full or when they would wait longer than MaxWait.
+type RateLimitConfig struct {
+	Upstream RateLimit `json:"upstream"`
+	Key      RateLimit `json:"key"`
+	// MaxQueue is the number of requests allowed to wait. Defaults to 64.
+	MaxQueue int `json:"maxQueue"`
+	// MaxWait is the longest a request may wait, e.g. "30s". Defaults to
+	// one minute.
+	MaxWait string `json:"maxWait"`
+}
+
+// bucket is a token bucket refilled continuously at perMinute per minute,
+// holding at most one minute's worth.
+type bucket struct {
+	perMinute float64
+	available float64
+	last      time.Time
+}
+
+func newBucket(perMinute float64) *bucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &bucket{perMinute: perMinute, available: perMinute, last: time.Now()}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.available = math.Min(b.perMinute, b.available+now.Sub(b.last).Minutes()*b.perMinute)
+	b.last = now
+}
+
+// wait returns how long until n units are available. Requests larger than
+// the whole bucket only wait for it to be full.
+func (b *bucket) wait(now time.Time, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	n = math.Min(n, b.perMinute)
+	if b.available >= n {
+		return 0
+	}
+	return time.Duration((n - b.available) / b.perMinute * float64(time.Minute))
+}
+
+func (b *bucket) take(n float64) {
+	if b != nil {
+		b.available -= n
+	}
+}
+
+// limitScope is the limiter state of one upstream or API key.
+type limitScope struct {
+	requests *bucket
+	tokens   *bucket
+	queued   int
+	admitted int64
+	rejected int64
+}
+
+// rateLimitError rejects a request that cannot be admitted in time.
+type rateLimitError struct {
+	scope      string
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("proxy rate limit for %s: %s", e.scope, e.reason)
+}
+
+type rateLimiter struct {
+	cfg      RateLimitConfig
+	maxWait  time.Duration
+	maxQueue int
+
+	mu     sync.Mutex
+	queued int
+	scopes map[string]*limitScope
+}
+
+func newRateLimiter(cfg RateLimitConfig) (*rateLimiter, error) {
+	l := &rateLimiter{cfg: cfg, maxWait: time.Minute, maxQueue: cfg.MaxQueue, scopes: map[string]*limitScope{}}
+	if cfg.MaxWait != "" {
+		d, err := time.ParseDuration(cfg.MaxWait)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit maxWait: %w", err)
+		}
+		l.maxWait = d
+	}
+	if l.maxQueue == 0 {
+		l.maxQueue = 64
+	}
+	return l, nil
+}
+
+func (l *rateLimiter) scope(name string, limit RateLimit) *limitScope {
+	if limit.RequestsPerMinute <= 0 && limit.TokensPerMinute <= 0 {
+		return nil
+	}
+	sc := l.scopes[name]
+	if sc == nil {
+		sc = &limitScope{
+			requests: newBucket(limit.RequestsPerMinute),
+			tokens:   newBucket(limit.TokensPerMinute),
+		}
+		l.scopes[name] = sc
+	}
+	return sc
+}
+
+// reservation holds the tokens estimated for an admitted request, to be
+// settled against the actual usage.
+type reservation struct {
+	l        *rateLimiter
+	scopes   []*limitScope
+	estimate float64
+}
+
+// Acquire waits until a request to upstream on behalf of key, estimated to
+// use tokens, fits in every budget that applies to it. keyLimit replaces the
+// configured key budget when set. It returns how long the request was
+// queued.
+func (l *rateLimiter) Acquire(ctx context.Context, upstream, key string, keyLimit *RateLimit, tokens float64) (*reservation, time.Duration, error) {
+	start := time.Now()
+	deadline := start.Add(l.maxWait)
+
+	if keyLimit == nil {
+		keyLimit = &l.cfg.Key
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var scopes []*limitScope
+	var names []string
+	for _, s := range []struct {
+		kind, id string
+		limit    RateLimit
+	}{
+		{"upstream", upstream, l.cfg.Upstream},
+		{"key", key, *keyLimit},
+	} {
+		if s.id == "" {
+			continue
+		}
+		name := s.kind + " " + s.id
+		if sc := l.scope(name, s.limit); sc != nil {
+			scopes = append(scopes, sc)
+			names = append(names, name)
+		}
+	}
+	res := &reservation{l: l, scopes: scopes, estimate: tokens}
+	if len(scopes) == 0 {
+		return res, 0, nil
+	}
+
+	queued := false
+	dequeue := func() {
+		if queued {
+			l.queued--
+			for _, sc := range scopes {
+				sc.queued--
+			}
+		}
+	}
+	reject := func(reason string, retryAfter time.Duration, blocking string) error {
+		dequeue()
+		for _, sc := range scopes {
+			sc.rejected++
+		}
+		return &rateLimitError{scope: blocking, reason: reason, retryAfter: retryAfter}
+	}
+	for {
+		now := time.Now()
+		var wait time.Duration
+		blocking := ""
+		for i, sc := range scopes {
+			w := max(sc.requests.wait(now, 1), sc.tokens.wait(now, tokens))
+			if w > wait {
+				wait, blocking = w, names[i]
+			}
+		}
+		if wait == 0 {
+			waited := time.Duration(0)
+			if queued {
+				waited = now.Sub(start)
+			}
+			dequeue()
+			for _, sc := range scopes {
+				sc.requests.take(1)
+				sc.tokens.take(tokens)
+				sc.admitted++
+			}
+			return res, waited, nil
+		}
+		if now.Add(wait).After(deadline) {
+			return nil, 0, reject(fmt.Sprintf("budget exhausted, would wait %s", wait.Round(time.Second)), wait, blocking)
+		}
+		if !queued {
+			if l.queued >= l.maxQueue {
+				return nil, 0, reject("queue full", wait, blocking)
+			}
+			queued = true
+			l.queued++
+			for _, sc := range scopes {
+				sc.queued++
+			}
+		}
+
+		l.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		l.mu.Lock()
+		if ctx.Err() != nil {
+			dequeue()
+			return nil, 0, ctx.Err()
+		}
+	}
+}
+
+// Settle charges the difference between the actual and estimated token
+// usage of an admitted request. Budgets may go into debt, delaying later
+// requests.
+func (r *reservation) Settle(usage *Usage) {
+	if r == nil || usage == nil || len(r.scopes) == 0 {
+		return
+	}
+	actual := float64(usage.InputTokens + usage.OutputTokens)
+	r.l.mu.Lock()
+	defer r.l.mu.Unlock()
+	for _, sc := range r.scopes {
+		sc.tokens.take(actual - r.estimate)
+	}
+}
+
+// Snapshot returns the limiter state for the stats endpoint.
+func (l *rateLimiter) Snapshot() map[string]any {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	scopes := map[string]any{}
+	for name, sc := range l.scopes {
+		state := map[string]any{
+			"queued":   sc.queued,
+			"admitted": sc.admitted,
+			"rejected": sc.rejected,
+		}
+		if sc.requests != nil {
+			sc.requests.refill(now)
+			state["requestsAvailable"] = math.Floor(sc.requests.available)
+		}
+		if sc.tokens != nil {
+			sc.tokens.refill(now)
+			state["tokensAvailable"] = math.Floor(sc.tokens.available)
+		}
+		scopes[name] = state
+	}
+	return map[string]any{"queued": l.queued, "scopes": scopes}
+}
+
+// estimateTokens guesses the tokens a request will use before it is sent:
+// roughly four bytes per token of input, plus the requested output cap.
+func estimateTokens(body []byte) float64 {
+	var req struct {
+		MaxTokens           float64 `json:"max_tokens"`
+		MaxCompletionTokens float64 `json:"max_completion_tokens"`
+	}
+	json.Unmarshal(body, &req)
+	return float64(len(body))/4 + max(req.MaxTokens, req.MaxCompletionTokens)
+}
+
+// apiKeyID identifies the API key of a request without revealing it.
+func apiKeyID(r *http.Request) string {
+	key, _ := clientKey(r)
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// writeRateLimited answers a rejected request the way providers do.
+func writeRateLimited(w http.ResponseWriter, err *rateLimitError) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(err.retryAfter.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, "rate_limit_exceeded", err.Error())
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tokensAvailable is the upstream token budget left in a limiter.
+func tokensAvailable(t *testing.T, l *rateLimiter, upstream string) float64 {
+	t.Helper()
+	scope, ok := l.Snapshot()["scopes"].(map[string]any)["upstream "+upstream].(map[string]any)
+	if !ok {
+		t.Fatalf("no scope for upstream %s", upstream)
+	}
+	return scope["tokensAvailable"].(float64)
+}
+
+func TestRateLimiterQueue(t *testing.T) {
+	// 1000 tokens a second
+	l, err := newRateLimiter(RateLimitConfig{Upstream: RateLimit{TokensPerMinute: 60000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, queued, err := l.Acquire(context.Background(), "api", "", nil, 60000); err != nil || queued != 0 {
+		t.Fatalf("first request: queued %s, %v, want admitted at once", queued, err)
+	}
+	start := time.Now()
+	_, queued, err := l.Acquire(context.Background(), "api", "", nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); queued < 90*time.Millisecond || queued > elapsed {
+		t.Errorf("queued %s in %s, want about 100ms", queued, elapsed)
+	}
+
+	// other upstreams have their own budget
+	if _, queued, err := l.Acquire(context.Background(), "other", "", nil, 100); err != nil || queued != 0 {
+		t.Errorf("other upstream: queued %s, %v, want admitted at once", queued, err)
+	}
+
+	// a request given up by its client leaves the queue
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := l.Acquire(ctx, "api", "", nil, 30000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("canceled request: err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := l.Snapshot()["queued"]; n != 0 {
+		t.Errorf("%v requests queued, want 0", n)
+	}
+}
+
+func TestRateLimiterRejects(t *testing.T) {
+	l, err := newRateLimiter(RateLimitConfig{
+		Upstream: RateLimit{TokensPerMinute: 60000},
+		Key:      RateLimit{RequestsPerMinute: 1},
+		MaxQueue: 1,
+		MaxWait:  "500ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := l.Acquire(context.Background(), "api", "", nil, 60000); err != nil {
+		t.Fatal(err)
+	}
+
+	// waiting longer than MaxWait
+	_, _, err = l.Acquire(context.Background(), "api", "", nil, 1000)
+	rlErr := (*rateLimitError)(nil)
+	if !errors.As(err, &rlErr) || rlErr.scope != "upstream api" || rlErr.retryAfter < 900*time.Millisecond {
+		t.Fatalf("err = %v, want the upstream budget exhausted for about 1s", err)
+	}
+
+	// a full queue
+	done := make(chan error)
+	go func() {
+		_, _, err := l.Acquire(context.Background(), "api", "", nil, 100)
+		done <- err
+	}()
+	for l.Snapshot()["queued"] != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	_, _, err = l.Acquire(context.Background(), "api", "", nil, 100)
+	if !errors.As(err, &rlErr) || rlErr.reason != "queue full" {
+		t.Errorf("err = %v, want the queue full", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("queued request: %v", err)
+	}
+
+	// the key budget applies across upstreams
+	if _, _, err := l.Acquire(context.Background(), "other", "k1", nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = l.Acquire(context.Background(), "third", "k1", nil, 1)
+	if !errors.As(err, &rlErr) || rlErr.scope != "key k1" {
+		t.Errorf("err = %v, want the budget of key k1 exhausted", err)
+	}
+	// unless the key has its own
+	if _, _, err := l.Acquire(context.Background(), "third", "k2", &RateLimit{RequestsPerMinute: 10}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := l.Acquire(context.Background(), "third", "k2", &RateLimit{RequestsPerMinute: 10}, 1); err != nil {
+		t.Errorf("key limit: %v", err)
+	}
+}
+
+func TestRateLimiterSettle(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		estimate float64
+		usage    *Usage
+		// spent is the tokens the request is charged in the end.
+		spent float64
+	}{
+		{"more than estimated", 1000, &Usage{InputTokens: 8000, OutputTokens: 2000}, 10000},
+		{"less than estimated", 5000, &Usage{InputTokens: 100, OutputTokens: 100}, 200},
+		{"no usage", 1000, nil, 1000},
+		{"not sent", 1000, &Usage{}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := newRateLimiter(RateLimitConfig{Upstream: RateLimit{TokensPerMinute: 60000}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, _, err := l.Acquire(context.Background(), "api", "", nil, tt.estimate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Settle(tt.usage)
+			// the bucket refills by 1000 tokens a second meanwhile
+			spent := 60000 - tokensAvailable(t, l, "api")
+			if spent > tt.spent || spent < tt.spent-100 {
+				t.Errorf("charged %g tokens, want %g", spent, tt.spent)
+			}
+		})
+	}
+}
+
+func TestRateLimitThroughProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":990,"total_tokens":1000}}`))
+	}))
+	defer upstream.Close()
+	proxyURL, exchanges := startProxy(t, &Config{
+		Upstream:  upstream.URL,
+		RateLimit: RateLimitConfig{Upstream: RateLimit{TokensPerMinute: 1000}, MaxWait: "1s"},
+	})
+	post := func() *http.Response {
+		resp, err := http.Post(proxyURL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4o","max_tokens":100}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// the estimate of 108 tokens is corrected to the 1000 used, spending
+	// the whole minute's budget
+	resp := post()
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	exchanges(1)
+
+	resp = post()
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", resp.StatusCode)
+	}
+	// the next request's 100 tokens and change refill in about 7s
+	if got := resp.Header.Get("Retry-After"); got != "7" {
+		t.Errorf("Retry-After = %q, want 7", got)
+	}
+	var e struct {
+		Error struct{ Message, Type string }
+	}
+	if err := json.Unmarshal(body, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Error.Type != "rate_limit_exceeded" || !strings.HasPrefix(e.Error.Message, "proxy rate limit for upstream ") {
+		t.Errorf("body = %s, want a rate_limit_exceeded error", body)
+	}
+	if x := exchanges(2)[1]; x.Status != http.StatusTooManyRequests || x.Error == "" {
+		t.Errorf("logged status %d, error %q, want the rejection", x.Status, x.Error)
+	}
+}
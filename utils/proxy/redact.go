@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// defaultSensitiveHeaders are masked entirely wherever they appear: as
+// headers, as JSON field names and as query parameters.
+var defaultSensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"X-Api-Key",
+	"Api-Key",
+	"X-Goog-Api-Key",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// sensitiveParams are query parameters carrying credentials, e.g. Gemini's
+// ?key=.
+var sensitiveParams = []string{"key", "api_key", "apikey", "access_token", "token"}
+
+// defaultSecretPatterns match well-known credential formats anywhere in a
+// logged value.
+var defaultSecretPatterns = []string{
+	`\bsk-[A-Za-z0-9_\-]{16,}`,     // OpenAI and Anthropic keys
+	`\bAIza[0-9A-Za-z_\-]{35}`,     // Google API keys
+	`\bgh[pousr]_[A-Za-z0-9]{36,}`, // GitHub tokens
+	`\bpxy-[0-9a-f]{48}\b`,         // proxy tokens
+	`(?i)\bbearer\s+[A-Za-z0-9._~+/\-]{16,}=*`,
+}
+
+// redactor masks secrets before anything reaches a log sink.
+type redactor struct {
+	// names are normalized sensitive header and field names, params the
+	// normalized sensitive query parameters.
+	names    map[string]bool
+	params   map[string]bool
+	patterns []*regexp.Regexp
+}
+
+func newRedactor(headers, patterns []string) (*redactor, error) {
+	r := &redactor{names: map[string]bool{}, params: map[string]bool{}}
+	for _, h := range append(defaultSensitiveHeaders, headers...) {
+		r.names[normalizeName(h)] = true
+		r.params[normalizeName(h)] = true
+	}
+	for _, p := range sensitiveParams {
+		r.params[normalizeName(p)] = true
+	}
+	for _, p := range append(defaultSecretPatterns, patterns...) {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern %q: %w", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// normalizeName makes X-Api-Key, x_api_key and xApiKey compare equal.
+func normalizeName(name string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(name))
+}
+
+func (r *redactor) sensitive(name string) bool {
+	return r.names[normalizeName(name)]
+}
+
+// String masks every secret pattern in s.
+func (r *redactor) String(s string) string {
+	for _, re := range r.patterns {
+		s = re.ReplaceAllString(s, redacted)
+	}
+	return s
+}
+
+func (r *redactor) Header(h http.Header) http.Header {
+	h = h.Clone()
+	for name, values := range h {
+		if r.sensitive(name) {
+			h[name] = []string{redacted}
+			continue
+		}
+		for i, v := range values {
+			values[i] = r.String(v)
+		}
+	}
+	return h
+}
+
+// Stored returns h without the headers that carry secrets, for responses
+// stored to be served again, where masked values would reach clients.
+func (r *redactor) Stored(h http.Header) http.Header {
+	h = h.Clone()
+	for name, values := range h {
+		if r.sensitive(name) {
+			delete(h, name)
+			continue
+		}
+		for _, v := range values {
+			if r.String(v) != v {
+				delete(h, name)
+				break
+			}
+		}
+	}
+	return h
+}
+
+// Query masks sensitive parameters and secret patterns in a raw query.
+func (r *redactor) Query(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return r.String(rawQuery)
+	}
+	for name, values := range q {
+		for i, v := range values {
+			if r.params[normalizeName(name)] {
+				values[i] = redacted
+			} else {
+				values[i] = r.String(v)
+			}
+		}
+	}
+	return q.Encode()
+}
+
+// URL returns u as a string with its query redacted.
+func (r *redactor) URL(u *url.URL) string {
+	u2 := *u
+	u2.User = nil
+	u2.RawQuery = r.Query(u.RawQuery)
+	return r.String(u2.String())
+}
+
+// Error returns the message of err with secrets masked, including
+// credentials in the URL of a failed upstream round trip.
+func (r *redactor) Error(err error) string {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		if u, perr := url.Parse(uerr.URL); perr == nil {
+			return r.String(fmt.Sprintf("%s %q: %v", uerr.Op, r.URL(u), uerr.Err))
+		}
+	}
+	return r.String(err.Error())
+}
+
+// JSON masks sensitive fields and secret patterns in a logged body. Bodies
+// without anything to mask are returned untouched, preserving key order.
+func (r *redactor) JSON(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 || !r.needsRedaction(raw) {
+		return raw
+	}
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		s, _ := json.Marshal(r.String(string(raw)))
+		return s
+	}
+	out, err := json.Marshal(r.value(v))
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func (r *redactor) needsRedaction(raw json.RawMessage) bool {
+	for _, re := range r.patterns {
+		if re.Match(raw) {
+			return true
+		}
+	}
+	return r.hasSensitiveKey(raw)
+}
+
+func (r *redactor) hasSensitiveKey(raw json.RawMessage) bool {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return false
+	}
+	switch raw[0] {
+	case '{':
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(raw, &obj) != nil {
+			return false
+		}
+		for k, v := range obj {
+			if r.sensitive(k) || r.hasSensitiveKey(v) {
+				return true
+			}
+		}
+	case '[':
+		var arr []json.RawMessage
+		if json.Unmarshal(raw, &arr) != nil {
+			return false
+		}
+		for _, v := range arr {
+			if r.hasSensitiveKey(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *redactor) value(v any) any {
+	switch v := v.(type) {
+	case string:
+		return r.String(v)
+	case map[string]any:
+		for k, val := range v {
+			if r.sensitive(k) {
+				v[k] = redacted
+			} else {
+				v[k] = r.value(val)
+			}
+		}
+	case []any:
+		for i, val := range v {
+			v[i] = r.value(val)
+		}
+	}
+	return v
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// RetryConfig retries requests that fail with a transient error. Retries
+// are off unless MaxAttempts is above 1. Budgets, rate limits and stats
+// count a retried request once.
+type RetryConfig struct {
+	// MaxAttempts is the total number of attempts, the first included.
+	MaxAttempts int `json:"maxAttempts"`
+	// Backoff is the delay before the first retry, doubled on each
+	// following one, e.g. "500ms". Defaults to 500ms.
+	Backoff string `json:"backoff"`
+	// MaxBackoff caps the delay between attempts, including delays asked
+	// for with Retry-After; a response asking for a longer delay is passed
+	// through. Defaults to 30s.
+	MaxBackoff string `json:"maxBackoff"`
+	// Statuses are the response statuses worth retrying. Defaults to 429,
+	// 500, 502, 503 and 504.
+	Statuses []int `json:"statuses"`
+}
+
+// Retry is a failed attempt, as recorded in the traffic log.
+type Retry struct {
+	Attempt int    `json:"attempt"`
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// WaitMS is the delay before the next attempt.
+	WaitMS float64 `json:"waitMs"`
+}
+
+type retriesKey struct{}
+
+// withRetries returns a context in which the retry transport appends the
+// failed attempts of a request to retries.
+func withRetries(ctx context.Context, retries *[]*Retry) context.Context {
+	return context.WithValue(ctx, retriesKey{}, retries)
+}
+
+// retryTransport retries requests on transient upstream failures, with
+// exponential backoff and full jitter.
+type retryTransport struct {
+	next        http.RoundTripper
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	statuses    []int
+	// redact masks credentials in the recorded errors.
+	redact *redactor
+}
+
+// newRetryTransport wraps next with the retry policy, or returns next as is
+// when retries are off.
+func newRetryTransport(next http.RoundTripper, cfg RetryConfig, redact *redactor) (http.RoundTripper, error) {
+	if cfg.MaxAttempts <= 1 {
+		return next, nil
+	}
+	t := &retryTransport{
+		next:        next,
+		maxAttempts: cfg.MaxAttempts,
+		backoff:     500 * time.Millisecond,
+		maxBackoff:  30 * time.Second,
+		statuses:    cfg.Statuses,
+		redact:      redact,
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"backoff", cfg.Backoff, &t.backoff},
+		{"maxBackoff", cfg.MaxBackoff, &t.maxBackoff},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("retry %s: %w", d.name, err)
+		}
+		*d.dst = v
+	}
+	if len(t.statuses) == 0 {
+		t.statuses = []int{
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		}
+	}
+	return t, nil
+}
+
+// resendable reports whether a request may be resent after a transport
+// error. Unless the connection could not even be made, the upstream may
+// already have processed the request, so only idempotent ones are resent.
+// Error statuses are always retried: the upstream refused the request.
+func resendable(req *http.Request, err error) bool {
+	if opErr := (*net.OpError)(nil); errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the body is already buffered by the server, so it is cheap to read it
+	// again for each attempt
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	retries, _ := req.Context().Value(retriesKey{}).(*[]*Retry)
+
+	for attempt := 1; ; attempt++ {
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := t.next.RoundTrip(req)
+		if attempt >= t.maxAttempts {
+			return resp, err
+		}
+		retry := &Retry{Attempt: attempt}
+		wait := t.delay(attempt)
+		switch {
+		case err != nil:
+			if !resendable(req, err) || req.Context().Err() != nil {
+				return resp, err
+			}
+			retry.Error = t.redact.Error(err)
+		case slices.Contains(t.statuses, resp.StatusCode):
+			if after, ok := retryAfter(resp.Header); ok {
+				if after > t.maxBackoff {
+					return resp, nil
+				}
+				wait = max(wait, after)
+			}
+			retry.Status = resp.StatusCode
+			// drain the body so that the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		default:
+			return resp, err
+		}
+		retry.WaitMS = float64(wait.Microseconds()) / 1000
+		if retries != nil {
+			*retries = append(*retries, retry)
+		}
+		reason := retry.Error
+		if retry.Status != 0 {
+			reason = http.StatusText(retry.Status)
+		}
+		log.Printf("retrying %s %s in %s after attempt %d failed: %s",
+			req.Method, t.redact.URL(req.URL), wait.Round(time.Millisecond), attempt, reason)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// delay returns the backoff before retrying after the given attempt: a
+// random duration up to the exponential backoff, capped at maxBackoff.
+func (t *retryTransport) delay(attempt int) time.Duration {
+	d := t.maxBackoff
+	if attempt < 32 {
+		d = min(d, t.backoff<<(attempt-1))
+	}
+	return time.Duration(rand.Int64N(int64(d) + 1))
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an HTTP date.
+func retryAfter(h http.Header) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upstreamResponse is a status an upstream answers with, and its
+// Retry-After header if any.
+type upstreamResponse struct {
+	status     int
+	retryAfter string
+}
+
+func TestRetryThroughProxy(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// responses are the upstream's answers to the attempts, in order.
+		responses  []upstreamResponse
+		status     int
+		retries    []int
+		minElapsed time.Duration
+	}{
+		{
+			name:      "transient statuses",
+			responses: []upstreamResponse{{503, ""}, {429, ""}, {200, ""}},
+			status:    http.StatusOK,
+			retries:   []int{503, 429},
+		},
+		{
+			name:      "attempts exhausted",
+			responses: []upstreamResponse{{500, ""}, {502, ""}, {504, ""}},
+			status:    http.StatusGatewayTimeout,
+			retries:   []int{500, 502},
+		},
+		{
+			name:      "not transient",
+			responses: []upstreamResponse{{400, ""}},
+			status:    http.StatusBadRequest,
+		},
+		{
+			name:       "retry after",
+			responses:  []upstreamResponse{{429, "1"}, {200, ""}},
+			status:     http.StatusOK,
+			retries:    []int{429},
+			minElapsed: time.Second,
+		},
+		{
+			name:      "retry after beyond the max backoff",
+			responses: []upstreamResponse{{429, "60"}},
+			status:    http.StatusTooManyRequests,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != `{"model":"gpt-4o"}` {
+					t.Errorf("attempt %d: body = %s", attempts.Load()+1, body)
+				}
+				resp := tt.responses[attempts.Add(1)-1]
+				if resp.retryAfter != "" {
+					w.Header().Set("Retry-After", resp.retryAfter)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(resp.status)
+				w.Write([]byte(`{}`))
+			}))
+			defer upstream.Close()
+			proxyURL, exchanges := startProxy(t, &Config{
+				Upstream: upstream.URL,
+				Retry:    RetryConfig{MaxAttempts: 3, Backoff: "1ms", MaxBackoff: "2s"},
+			})
+
+			start := time.Now()
+			resp, err := http.Post(proxyURL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4o"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			elapsed := time.Since(start)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if n := int(attempts.Load()); n != len(tt.responses) {
+				t.Errorf("%d attempts, want %d", n, len(tt.responses))
+			}
+			if elapsed < tt.minElapsed {
+				t.Errorf("answered after %s, want at least %s", elapsed, tt.minElapsed)
+			}
+
+			x := exchanges(1)[0]
+			if x.Status != tt.status || len(x.Retries) != len(tt.retries) {
+				t.Fatalf("logged status %d with %d retries, want %d with %d", x.Status, len(x.Retries), tt.status, len(tt.retries))
+			}
+			for i, retry := range x.Retries {
+				if retry.Attempt != i+1 || retry.Status != tt.retries[i] {
+					t.Errorf("retry %d: attempt %d, status %d, want attempt %d, status %d", i, retry.Attempt, retry.Status, i+1, tt.retries[i])
+				}
+			}
+			if tt.minElapsed > 0 && x.Retries[0].WaitMS < float64(tt.minElapsed.Milliseconds()) {
+				t.Errorf("waited %gms, want the %s asked for", x.Retries[0].WaitMS, tt.minElapsed)
+			}
+		})
+	}
+}
+
+func TestRetryConnectionFailures(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	readErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	for _, tt := range []struct {
+		name     string
+		method   string
+		header   http.Header
+		err      error
+		attempts int
+	}{
+		{"dial failure", http.MethodPost, nil, dialErr, 3},
+		{"post after connecting", http.MethodPost, nil, readErr, 1},
+		{"idempotency key", http.MethodPost, http.Header{"Idempotency-Key": {"k1"}}, readErr, 3},
+		{"get", http.MethodGet, nil, readErr, 3},
+		{"put", http.MethodPut, nil, readErr, 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			transport, err := newRetryTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				attempts++
+				return nil, tt.err
+			}), RetryConfig{MaxAttempts: 3, Backoff: "1ms"}, &redactor{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var retries []*Retry
+			req := httptest.NewRequest(tt.method, "http://upstream/v1/chat/completions", strings.NewReader(`{}`))
+			req.Header = tt.header
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			req = req.WithContext(withRetries(req.Context(), &retries))
+			if _, err := transport.RoundTrip(req); !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("%d attempts, want %d", attempts, tt.attempts)
+			}
+			if len(retries) != tt.attempts-1 {
+				t.Fatalf("%d retries recorded, want %d", len(retries), tt.attempts-1)
+			}
+			for _, retry := range retries {
+				if !strings.Contains(retry.Error, tt.err.Error()) {
+					t.Errorf("retry error = %q, want %q", retry.Error, tt.err)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	for _, tt := range []struct {
+		value string
+		min   time.Duration
+		max   time.Duration
+		ok    bool
+	}{
+		{"", 0, 0, false},
+		{"3", 3 * time.Second, 3 * time.Second, true},
+		{date, 58 * time.Second, time.Minute, true},
+		{"Mon, 01 Jan 2001 00:00:00 GMT", 0, 0, true},
+		{"soon", 0, 0, false},
+	} {
+		d, ok := retryAfter(http.Header{"Retry-After": {tt.value}})
+		if ok != tt.ok || d < tt.min || d > tt.max {
+			t.Errorf("retryAfter(%q) = %s, %t, want %s to %s, %t", tt.value, d, ok, tt.min, tt.max, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Patch operations. add, replace and remove follow JSON Patch (RFC 6902),
+// except that replace adds missing values and removing a missing value is
+// not an error, so that rules apply to requests whatever their shape.
+const (
+	patchAdd     = "add"
+	patchReplace = "replace"
+	patchRemove  = "remove"
+	// patchCap lowers the number at path to value, or sets it when missing,
+	// e.g. to cap max_tokens.
+	patchCap = "cap"
+	// patchSystem replaces the system prompt with value, or inserts it
+	// when the request has none. It ignores path.
+	patchSystem = "system"
+)
+
+// PatchOp is a mutation of the request body.
+type PatchOp struct {
+	Op string `json:"op"`
+	// Path is a JSON pointer, e.g. "/temperature" or "/messages/0".
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+
+	tokens []string
+	value  any
+}
+
+// RewriteRule patches the body of matching requests before they are
+// forwarded.
+type RewriteRule struct {
+	Name  string       `json:"name"`
+	Match RequestMatch `json:"match"`
+	Patch []*PatchOp   `json:"patch"`
+}
+
+// parseSetFlag parses the -set shorthand, path=value, into a rule replacing
+// a value in every request. The path is a JSON pointer with or without its
+// leading slash; the value is JSON, or else a string.
+func parseSetFlag(spec string) (*RewriteRule, error) {
+	path, value, ok := strings.Cut(spec, "=")
+	if !ok || path == "" {
+		return nil, fmt.Errorf("set %q: expected path=value", spec)
+	}
+	raw := json.RawMessage(value)
+	if !json.Valid(raw) {
+		raw, _ = json.Marshal(value)
+	}
+	return &RewriteRule{
+		Name:  "set " + spec,
+		Patch: []*PatchOp{{Op: patchReplace, Path: "/" + strings.TrimPrefix(path, "/"), Value: raw}},
+	}, nil
+}
+
+// rewriter applies the rewrite rules.
+type rewriter struct {
+	rules []*RewriteRule
+}
+
+func newRewriter(rules []*RewriteRule) (*rewriter, error) {
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		for _, op := range rule.Patch {
+			switch op.Op {
+			case patchAdd, patchReplace, patchCap, patchSystem:
+				if len(op.Value) == 0 {
+					return nil, fmt.Errorf("rewrite %s: %s needs a value", rule.Name, op.Op)
+				}
+				d := json.NewDecoder(bytes.NewReader(op.Value))
+				d.UseNumber()
+				if err := d.Decode(&op.value); err != nil {
+					return nil, fmt.Errorf("rewrite %s: %w", rule.Name, err)
+				}
+			case patchRemove:
+			default:
+				return nil, fmt.Errorf("rewrite %s: unknown op %q", rule.Name, op.Op)
+			}
+			if _, ok := op.value.(json.Number); op.Op == patchCap && !ok {
+				return nil, fmt.Errorf("rewrite %s: cap needs a number", rule.Name)
+			}
+			if _, ok := op.value.(string); op.Op == patchSystem && !ok {
+				return nil, fmt.Errorf("rewrite %s: system needs a string", rule.Name)
+			}
+			if op.Op == patchSystem {
+				continue
+			}
+			if !strings.HasPrefix(op.Path, "/") {
+				return nil, fmt.Errorf("rewrite %s: path %q must start with /", rule.Name, op.Path)
+			}
+			for _, t := range strings.Split(op.Path[1:], "/") {
+				op.tokens = append(op.tokens, strings.NewReplacer("~1", "/", "~0", "~").Replace(t))
+			}
+		}
+	}
+	return &rewriter{rules: rules}, nil
+}
+
+// Apply patches a JSON request body with every matching rule, in order. It
+// returns the new body and the names of the rules applied, or the body
+// unchanged if no rule applied.
+func (rw *rewriter) Apply(r *http.Request, body []byte) ([]byte, []string, error) {
+	if len(rw.rules) == 0 {
+		return body, nil, nil
+	}
+	var doc any
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if d.Decode(&doc) != nil {
+		// not JSON, nothing to patch
+		return body, nil, nil
+	}
+	var applied []string
+	for _, rule := range rw.rules {
+		// the model may have been rewritten by an earlier rule
+		model, _ := jsonObject(doc)["model"].(string)
+		if !rule.Match.matches(r, model) {
+			continue
+		}
+		for _, op := range rule.Patch {
+			var err error
+			if op.Op == patchSystem {
+				err = setSystemPrompt(doc, r.URL.Path, op.value.(string))
+			} else {
+				doc, err = op.apply(doc, op.tokens)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("rewrite %s: %s %s: %w", rule.Name, op.Op, op.Path, err)
+			}
+		}
+		applied = append(applied, rule.Name)
+	}
+	if len(applied) == 0 {
+		return body, nil, nil
+	}
+	out, err := json.Marshal(doc)
+	return out, applied, err
+}
+
+func jsonObject(v any) map[string]any {
+	m, _ := v.(map[string]any)
+	return m
+}
+
+// apply performs the operation at the path tokens within node and returns
+// the new node.
+func (op *PatchOp) apply(node any, tokens []string) (any, error) {
+	if len(tokens) == 0 {
+		if op.Op == patchRemove {
+			return nil, nil
+		}
+		return op.value, nil
+	}
+	key := tokens[0]
+	switch n := node.(type) {
+	case map[string]any:
+		if len(tokens) > 1 {
+			child, ok := n[key]
+			if !ok {
+				if op.Op == patchRemove {
+					return n, nil
+				}
+				child = map[string]any{}
+			}
+			child, err := op.apply(child, tokens[1:])
+			n[key] = child
+			return n, err
+		}
+		switch op.Op {
+		case patchRemove:
+			delete(n, key)
+		case patchCap:
+			if !below(n[key], op.value) {
+				n[key] = op.value
+			}
+		default:
+			n[key] = op.value
+		}
+		return n, nil
+	case []any:
+		i := len(n)
+		if key != "-" {
+			var err error
+			if i, err = strconv.Atoi(key); err != nil || i < 0 {
+				return n, fmt.Errorf("bad array index %q", key)
+			}
+		}
+		if i >= len(n) && op.Op == patchRemove {
+			// nothing to remove
+			return n, nil
+		}
+		if i > len(n) {
+			return n, fmt.Errorf("bad array index %q", key)
+		}
+		if len(tokens) > 1 {
+			if i == len(n) {
+				return n, fmt.Errorf("array index %q out of range", key)
+			}
+			child, err := op.apply(n[i], tokens[1:])
+			n[i] = child
+			return n, err
+		}
+		switch op.Op {
+		case patchAdd:
+			return slices.Insert(n, i, op.value), nil
+		case patchRemove:
+			return slices.Delete(n, i, i+1), nil
+		case patchCap:
+			if i == len(n) {
+				return append(n, op.value), nil
+			}
+			if !below(n[i], op.value) {
+				n[i] = op.value
+			}
+		default:
+			if i == len(n) {
+				return append(n, op.value), nil
+			}
+			n[i] = op.value
+		}
+		return n, nil
+	}
+	return node, fmt.Errorf("%q is not within an object or array", key)
+}
+
+// below reports whether v is a number no greater than limit.
+func below(v, limit any) bool {
+	n, ok := v.(json.Number)
+	if !ok {
+		return false
+	}
+	a, err1 := n.Float64()
+	b, err2 := limit.(json.Number).Float64()
+	return err1 == nil && err2 == nil && a <= b
+}
+
+// setSystemPrompt replaces or inserts the system prompt: the top-level
+// system field of Anthropic messages requests, or else the first system
+// message of OpenAI chat requests.
+func setSystemPrompt(doc any, path, prompt string) error {
+	obj := jsonObject(doc)
+	if obj == nil {
+		return fmt.Errorf("request body is not an object")
+	}
+	if _, ok := obj["system"]; ok || strings.HasSuffix(path, "/messages") {
+		obj["system"] = prompt
+		return nil
+	}
+	messages, _ := obj["messages"].([]any)
+	for _, m := range messages {
+		if msg := jsonObject(m); msg != nil && (msg["role"] == "system" || msg["role"] == "developer") {
+			msg["content"] = prompt
+			return nil
+		}
+	}
+	obj["messages"] = append([]any{map[string]any{"role": "system", "content": prompt}}, messages...)
+	return nil
+}
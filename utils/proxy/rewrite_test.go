@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRewriterApply(t *testing.T) {
+	op := func(op, path, value string) *PatchOp {
+		return &PatchOp{Op: op, Path: path, Value: json.RawMessage(value)}
+	}
+	for _, tt := range []struct {
+		name  string
+		rules []*RewriteRule
+		path  string
+		body  string
+		// want is the patched body, and applied the names of the rules
+		// applied; without them the body is unchanged.
+		want    string
+		applied []string
+		err     string
+	}{
+		{
+			name:    "add",
+			rules:   []*RewriteRule{{Patch: []*PatchOp{op(patchAdd, "/temperature", "0")}}},
+			body:    `{"model":"gpt-4o"}`,
+			want:    `{"model":"gpt-4o","temperature":0}`,
+			applied: []string{"rule 1"},
+		},
+		{
+			name: "add to arrays",
+			rules: []*RewriteRule{{Patch: []*PatchOp{
+				op(patchAdd, "/messages/0", `{"role":"system","content":"Be brief."}`),
+				op(patchAdd, "/messages/-", `{"role":"user","content":"Thanks"}`),
+			}}},
+			body:    `{"messages":[{"role":"user","content":"Hi"}]}`,
+			want:    `{"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Hi"},{"role":"user","content":"Thanks"}]}`,
+			applied: []string{"rule 1"},
+		},
+		{
+			name:    "replace adds missing objects",
+			rules:   []*RewriteRule{{Name: "user", Patch: []*PatchOp{op(patchReplace, "/metadata/user", `"evals"`)}}},
+			body:    `{"model":"gpt-4o"}`,
+			want:    `{"model":"gpt-4o","metadata":{"user":"evals"}}`,
+			applied: []string{"user"},
+		},
+		{
+			name: "remove",
+			rules: []*RewriteRule{{Patch: []*PatchOp{
+				op(patchRemove, "/tools", ""),
+				op(patchRemove, "/messages/0", ""),
+				op(patchRemove, "/metadata/user", ""),
+				op(patchRemove, "/messages/5", ""),
+				op(patchRemove, "/messages/7/content", ""),
+			}}},
+			body:    `{"tools":[{"type":"function"}],"messages":[{"role":"system"},{"role":"user"}]}`,
+			want:    `{"messages":[{"role":"user"}]}`,
+			applied: []string{"rule 1"},
+		},
+		{
+			name: "cap",
+			rules: []*RewriteRule{{Patch: []*PatchOp{
+				op(patchCap, "/max_tokens", "1000"),
+				op(patchCap, "/n", "2"),
+				op(patchCap, "/max_completion_tokens", "1000"),
+			}}},
+			body:    `{"max_tokens":4096,"n":1}`,
+			want:    `{"max_tokens":1000,"n":1,"max_completion_tokens":1000}`,
+			applied: []string{"rule 1"},
+		},
+		{
+			name:    "escaped pointer",
+			rules:   []*RewriteRule{{Patch: []*PatchOp{op(patchReplace, "/metadata/a~1b", "1"), op(patchReplace, "/metadata/c~0d", "2")}}},
+			body:    `{"metadata":{}}`,
+			want:    `{"metadata":{"a/b":1,"c~d":2}}`,
+			applied: []string{"rule 1"},
+		},
+		{
+			name:    "system message replaced",
+			rules:   []*RewriteRule{{Patch: []*PatchOp{op(patchSystem, "", `"Be brief."`)}}},
+			path:    "/v1/chat/completions",
+			body:    `{"messages":[{"role":"developer","content":"Be long."},{"role":"user","content":"Hi"}]}`,
+			want:    `{"messages":[{"role":"developer","content":"Be brief."},{"role":"user","content":"Hi"}]}`,
+			applied: []string{"rule 1"},
+		},
+		{
+			name:    "system message inserted",
+			rules:   []*RewriteRule{{Patch: []*PatchOp{op(patchSystem, "", `"Be brief."`)}}},
+			path:    "/v1/chat/completions",
+			body:    `{"messages":[{"role":"user","content":"Hi"}]}`,
+			want:    `{"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Hi"}]}`,
+			applied: []string{"rule 1"},
+		},
+		{
+			name:    "anthropic system",
+			rules:   []*RewriteRule{{Patch: []*PatchOp{op(patchSystem, "", `"Be brief."`)}}},
+			path:    "/v1/messages",
+			body:    `{"messages":[{"role":"user","content":"Hi"}]}`,
+			want:    `{"system":"Be brief.","messages":[{"role":"user","content":"Hi"}]}`,
+			applied: []string{"rule 1"},
+		},
+		{
+			name: "match on the rewritten model",
+			rules: []*RewriteRule{
+				{Name: "pin", Patch: []*PatchOp{op(patchReplace, "/model", `"gpt-4.1"`)}},
+				{Name: "old", Match: RequestMatch{Model: "gpt-4o"}, Patch: []*PatchOp{op(patchRemove, "/tools", "")}},
+				{Name: "new", Match: RequestMatch{Model: "gpt-4.1"}, Patch: []*PatchOp{op(patchAdd, "/temperature", "0")}},
+			},
+			body:    `{"model":"gpt-4o","tools":[]}`,
+			want:    `{"model":"gpt-4.1","tools":[],"temperature":0}`,
+			applied: []string{"pin", "new"},
+		},
+		{
+			name:  "no match",
+			rules: []*RewriteRule{{Match: RequestMatch{Path: "/v1/messages"}, Patch: []*PatchOp{op(patchRemove, "/tools", "")}}},
+			body:  `{"tools":[]}`,
+		},
+		{
+			name:  "not JSON",
+			rules: []*RewriteRule{{Patch: []*PatchOp{op(patchRemove, "/tools", "")}}},
+			body:  `tools=1`,
+		},
+		{
+			name:  "array index out of range",
+			rules: []*RewriteRule{{Patch: []*PatchOp{op(patchReplace, "/messages/3/content", `"Hi"`)}}},
+			body:  `{"messages":[]}`,
+			err:   `rewrite rule 1: replace /messages/3/content: bad array index "3"`,
+		},
+		{
+			name:  "path through a string",
+			rules: []*RewriteRule{{Name: "deep", Patch: []*PatchOp{op(patchAdd, "/model/name", `"gpt-4o"`)}}},
+			body:  `{"model":"gpt-4o"}`,
+			err:   `rewrite deep: add /model/name: "name" is not within an object or array`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rw, err := newRewriter(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := tt.path
+			if path == "" {
+				path = "/v1/chat/completions"
+			}
+			r := httptest.NewRequest(http.MethodPost, path, nil)
+			got, applied, err := rw.Apply(r, []byte(tt.body))
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("err = %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(applied, tt.applied) {
+				t.Errorf("applied = %q, want %q", applied, tt.applied)
+			}
+			want := tt.want
+			if want == "" {
+				want = tt.body
+				if string(got) != want {
+					t.Errorf("body = %s, want it unchanged", got)
+				}
+				return
+			}
+			if !jsonEqual(t, got, []byte(want)) {
+				t.Errorf("body = %s\nwant %s", got, want)
+			}
+		})
+	}
+}
+
+func TestNewRewriterErrors(t *testing.T) {
+	for _, tt := range []struct {
+		op   *PatchOp
+		want string
+	}{
+		{&PatchOp{Op: "move", Path: "/a"}, `rewrite rule 1: unknown op "move"`},
+		{&PatchOp{Op: patchAdd, Path: "/a"}, "rewrite rule 1: add needs a value"},
+		{&PatchOp{Op: patchCap, Path: "/max_tokens", Value: json.RawMessage(`"1000"`)}, "rewrite rule 1: cap needs a number"},
+		{&PatchOp{Op: patchSystem, Value: json.RawMessage(`1`)}, "rewrite rule 1: system needs a string"},
+		{&PatchOp{Op: patchRemove, Path: "tools"}, `rewrite rule 1: path "tools" must start with /`},
+	} {
+		_, err := newRewriter([]*RewriteRule{{Patch: []*PatchOp{tt.op}}})
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s %s: err = %v, want %s", tt.op.Op, tt.op.Path, err, tt.want)
+		}
+	}
+}
+
+func TestParseSetFlag(t *testing.T) {
+	for spec, want := range map[string]string{
+		"model=gpt-4.1":        `"gpt-4.1"`,
+		"/temperature=0":       `0`,
+		"stop=[\"END\"]":       `["END"]`,
+		"metadata/user=evals":  `"evals"`,
+		"reasoning_effort=low": `"low"`,
+	} {
+		rule, err := parseSetFlag(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path, _, _ := strings.Cut(spec, "=")
+		op := rule.Patch[0]
+		if op.Op != patchReplace || op.Path != "/"+strings.TrimPrefix(path, "/") || !jsonEqual(t, op.Value, []byte(want)) {
+			t.Errorf("%s: %s %s %s, want replace /%s %s", spec, op.Op, op.Path, op.Value, strings.TrimPrefix(path, "/"), want)
+		}
+	}
+	if _, err := parseSetFlag("model"); err == nil {
+		t.Error("set without a value accepted")
+	}
+}
+
+func TestRewriteFailureNotForwarded(t *testing.T) {
+	var forwarded atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+	proxyURL, exchanges := startProxy(t, &Config{
+		Upstream: upstream.URL,
+		Rewrites: []*RewriteRule{{Name: "first message", Patch: []*PatchOp{{Op: patchReplace, Path: "/messages/0/content", Value: json.RawMessage(`"Hi"`)}}}},
+	})
+	resp, err := http.Post(proxyURL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4o","messages":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || body.Error.Type != "invalid_request_error" || !strings.Contains(body.Error.Message, "first message") {
+		t.Errorf("status %d, error %+v, want a 400 invalid_request_error naming the rule", resp.StatusCode, body.Error)
+	}
+	if n := forwarded.Load(); n != 0 {
+		t.Errorf("forwarded %d requests, want none", n)
+	}
+	if x := exchanges(1)[0]; x.Status != http.StatusBadRequest || x.Error == "" {
+		t.Errorf("logged status %d, error %q, want the 400 and the rule error", x.Status, x.Error)
+	}
+}
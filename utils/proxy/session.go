@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// sessionPrefix lets clients that cannot set headers name their session in
+// the base URL instead, as in http://proxy:8080/_session/my-eval/v1. The
+// prefix is stripped before routing.
+const sessionPrefix = "/_session/"
+
+// traceID returns the trace ID of a W3C traceparent header, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func traceID(traceparent string) string {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || strings.Trim(parts[1], "0") == "" {
+		return ""
+	}
+	for _, c := range parts[1] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return ""
+		}
+	}
+	return parts[1]
+}
+
+// correlate identifies the session and trace of a request. The session is,
+// in order of preference, the session header, the session path prefix,
+// which is then stripped from the request, or the trace ID.
+func correlate(r *http.Request, header string) (session, trace string) {
+	trace = traceID(r.Header.Get("traceparent"))
+	session = r.Header.Get(header)
+	if rest, ok := strings.CutPrefix(r.URL.EscapedPath(), sessionPrefix); ok {
+		name, path, _ := strings.Cut(rest, "/")
+		if name, err := url.PathUnescape(name); err == nil && session == "" {
+			session = name
+		}
+		if u, err := url.Parse("/" + path); err == nil {
+			r.URL.Path, r.URL.RawPath = u.Path, u.RawPath
+		}
+	}
+	if session == "" {
+		session = trace
+	}
+	return session, trace
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Totals accumulate the requests, tokens and cost of a set of exchanges.
+type Totals struct {
+	Requests int64 `json:"requests"`
+	Usage
+	CostUSD float64 `json:"costUsd"`
+	// UnpricedRequests reported usage for a model missing from the pricing
+	// table, so CostUSD underestimates the real cost.
+	UnpricedRequests int64 `json:"unpricedRequests,omitempty"`
+}
+
+func (t *Totals) add(x *Exchange) {
+	t.Requests++
+	if x.Usage == nil {
+		return
+	}
+	t.Usage.Add(*x.Usage)
+	t.CostUSD += x.CostUSD
+	if !x.Priced {
+		t.UnpricedRequests++
+	}
+}
+
+// stats keeps running totals overall and per model, client and session.
+type stats struct {
+	mu        sync.Mutex
+	total     Totals
+	byModel   map[string]*Totals
+	byClient  map[string]*Totals
+	bySession map[string]*Totals
+}
+
+func newStats() *stats {
+	return &stats{
+		byModel:   map[string]*Totals{},
+		byClient:  map[string]*Totals{},
+		bySession: map[string]*Totals{},
+	}
+}
+
+func (s *stats) Add(x *Exchange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total.add(x)
+	for _, group := range []struct {
+		m   map[string]*Totals
+		key string
+	}{
+		{s.byModel, x.Model},
+		{s.byClient, x.Client},
+		{s.bySession, x.Session},
+	} {
+		if group.key == "" {
+			continue
+		}
+		t := group.m[group.key]
+		if t == nil {
+			t = &Totals{}
+			group.m[group.key] = t
+		}
+		t.add(x)
+	}
+}
+
+// Snapshot returns a copy of the totals.
+func (s *stats) Snapshot() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clone := func(m map[string]*Totals) map[string]Totals {
+		c := make(map[string]Totals, len(m))
+		for k, v := range m {
+			c[k] = *v
+		}
+		return c
+	}
+	return map[string]any{
+		"total":     s.total,
+		"byModel":   clone(s.byModel),
+		"byClient":  clone(s.byClient),
+		"bySession": clone(s.bySession),
+	}
+}
+
+// writeJSON answers with v as indented JSON.
+func writeJSON(w http.ResponseWriter, v any) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// bodyDecoder decodes a body as it streams through the proxy. A single
+// decoder is kept for the whole body, so compressed frames that span several
+// writes are handled correctly.
+type bodyDecoder struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+func newBodyDecoder(dst io.Writer, decode decodeFunc) *bodyDecoder {
+	pr, pw := io.Pipe()
+	d := &bodyDecoder{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		var r io.Reader = pr
+		var err error
+		if decode != nil {
+			r, err = decode(pr)
+		}
+		if err == nil {
+			_, err = io.Copy(dst, r)
+			if rc, ok := r.(io.Closer); ok {
+				rc.Close()
+			}
+		}
+		d.err = err
+		// unblock any further writes, even if decoding stopped early
+		pr.CloseWithError(err)
+	}()
+	return d
+}
+
+func (d *bodyDecoder) Write(p []byte) (int, error) {
+	return d.pw.Write(p)
+}
+
+// Close waits for the decoder to consume everything written so far.
+func (d *bodyDecoder) Close() error {
+	d.pw.Close()
+	<-d.done
+	return d.err
+}
+
+// writeEvent sends v as a server-sent event and flushes it to the client.
+func writeEvent(w http.ResponseWriter, v any) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	http.NewResponseController(w).Flush()
+}
+
+func isEventStream(h http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// sseAssembler parses a server-sent events stream and reassembles OpenAI
+// chat completion chunks into a single chat completion, concatenating
+// content and tool call deltas. Events that are not completion chunks are
+// kept as is.
+type sseAssembler struct {
+	buf        bytes.Buffer
+	event      string
+	data       []string
+	completion *chatCompletion
+	events     []json.RawMessage
+}
+
+func (a *sseAssembler) Write(p []byte) (int, error) {
+	a.buf.Write(p)
+	for {
+		i := bytes.IndexByte(a.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		a.line(strings.TrimRight(string(a.buf.Next(i+1)), "\r\n"))
+	}
+	return len(p), nil
+}
+
+func (a *sseAssembler) line(line string) {
+	field, value, _ := strings.Cut(line, ":")
+	value = strings.TrimPrefix(value, " ")
+	switch {
+	case line == "":
+		a.dispatch()
+	case field == "":
+		// comment
+	case field == "data":
+		a.data = append(a.data, value)
+	case field == "event":
+		a.event = value
+	}
+}
+
+func (a *sseAssembler) dispatch() {
+	defer func() {
+		a.event = ""
+		a.data = nil
+	}()
+	if len(a.data) == 0 {
+		return
+	}
+	data := strings.Join(a.data, "\n")
+	if data == "[DONE]" {
+		return
+	}
+	var chunk chatCompletion
+	if err := json.Unmarshal([]byte(data), &chunk); err == nil && chunk.Object == "chat.completion.chunk" {
+		a.merge(&chunk)
+		return
+	}
+	raw := json.RawMessage(data)
+	if !json.Valid(raw) {
+		raw, _ = json.Marshal(data)
+	}
+	if a.event != "" {
+		raw, _ = json.Marshal(map[string]any{"event": a.event, "data": raw})
+	}
+	a.events = append(a.events, raw)
+}
+
+func (a *sseAssembler) merge(chunk *chatCompletion) {
+	c := a.completion
+	if c == nil {
+		c = &chatCompletion{Object: "chat.completion"}
+		a.completion = c
+	}
+	if chunk.ID != "" {
+		c.ID = chunk.ID
+	}
+	if chunk.Created != 0 {
+		c.Created = chunk.Created
+	}
+	if chunk.Model != "" {
+		c.Model = chunk.Model
+	}
+	if len(chunk.Usage) > 0 && string(chunk.Usage) != "null" {
+		c.Usage = chunk.Usage
+	}
+	for _, delta := range chunk.Choices {
+		var choice *chatChoice
+		for _, existing := range c.Choices {
+			if existing.Index == delta.Index {
+				choice = existing
+			}
+		}
+		if choice == nil {
+			choice = &chatChoice{Index: delta.Index, Message: &chatMessage{}}
+			c.Choices = append(c.Choices, choice)
+		}
+		if delta.FinishReason != nil {
+			choice.FinishReason = delta.FinishReason
+		}
+		if delta.Delta == nil {
+			continue
+		}
+		msg := choice.Message
+		if delta.Delta.Role != "" {
+			msg.Role = delta.Delta.Role
+		}
+		msg.Content += delta.Delta.Content
+		for _, tcDelta := range delta.Delta.ToolCalls {
+			var tc *toolCall
+			for _, existing := range msg.ToolCalls {
+				if tcDelta.Index == nil || (existing.Index != nil && *existing.Index == *tcDelta.Index) {
+					tc = existing
+				}
+			}
+			if tc == nil {
+				tc = &toolCall{Index: tcDelta.Index}
+				msg.ToolCalls = append(msg.ToolCalls, tc)
+			}
+			if tcDelta.ID != "" {
+				tc.ID = tcDelta.ID
+			}
+			if tcDelta.Type != "" {
+				tc.Type = tcDelta.Type
+			}
+			tc.Function.Name += tcDelta.Function.Name
+			tc.Function.Arguments += tcDelta.Function.Arguments
+		}
+	}
+}
+
+// Result returns the reassembled chat completion, or the raw events when the
+// stream did not carry completion chunks.
+func (a *sseAssembler) Result() any {
+	// flush a trailing event that was not terminated by a blank line
+	if a.buf.Len() > 0 {
+		a.line(a.buf.String())
+		a.buf.Reset()
+	}
+	a.dispatch()
+	if a.completion == nil {
+		return a.events
+	}
+	for _, choice := range a.completion.Choices {
+		for _, tc := range choice.Message.ToolCalls {
+			tc.Index = nil
+		}
+	}
+	return a.completion
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// streamEncoder compresses a stream, flushing whole frames on demand.
+type streamEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// nopEncoder is the identity streamEncoder.
+type nopEncoder struct{ io.Writer }
+
+func (nopEncoder) Flush() error { return nil }
+func (nopEncoder) Close() error { return nil }
+
+func TestStreamThroughProxy(t *testing.T) {
+	events := []string{
+		`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}` + "\n\n",
+		// an event split across writes
+		`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1,"model":"gpt-4o",`,
+		`"choices":[{"index":0,"delta":{"content":"lo"}}]}` + "\n\n",
+		`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"read","arguments":"{\"pa"}}]}}]}` + "\n\n",
+		`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"th\":\"a\"}"}}]}}]}` + "\n\n",
+		`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}` + "\n\n",
+		// the usage chunk has no choices
+		`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}` + "\n\n",
+		"data: [DONE]\n\n",
+	}
+	want := `{"id":"chatcmpl-1","object":"chat.completion","created":1,"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"Hello","tool_calls":[{"id":"call_1","type":"function","function":{"name":"read","arguments":"{\"path\":\"a\"}"}}]},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`
+
+	for _, tt := range []struct {
+		encoding string
+		encoder  func(io.Writer) streamEncoder
+		decoder  func(io.Reader) (io.Reader, error)
+	}{
+		{
+			encoding: "identity",
+			encoder:  func(w io.Writer) streamEncoder { return nopEncoder{w} },
+			decoder:  func(r io.Reader) (io.Reader, error) { return r, nil },
+		},
+		{
+			encoding: "br",
+			encoder:  func(w io.Writer) streamEncoder { return brotli.NewWriter(w) },
+			decoder:  func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		},
+		{
+			encoding: "gzip",
+			encoder:  func(w io.Writer) streamEncoder { return gzip.NewWriter(w) },
+			decoder:  func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		},
+	} {
+		t.Run(tt.encoding, func(t *testing.T) {
+			received := make(chan struct{})
+			var sent int64
+			var stalled bool
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.Header().Set("Content-Encoding", tt.encoding)
+				var buf bytes.Buffer
+				enc := tt.encoder(&buf)
+				// each compressed frame is sent in two writes, so that
+				// frames are split across chunks
+				send := func() {
+					b := buf.Bytes()
+					for _, part := range [][]byte{b[:len(b)/2], b[len(b)/2:]} {
+						n, _ := w.Write(part)
+						sent += int64(n)
+						w.(http.Flusher).Flush()
+					}
+					buf.Reset()
+				}
+				for i, event := range events {
+					enc.Write([]byte(event))
+					enc.Flush()
+					send()
+					if i == 0 {
+						// the rest of the stream waits for the client to
+						// get the first chunk
+						select {
+						case <-received:
+						case <-time.After(5 * time.Second):
+							stalled = true
+						}
+					}
+				}
+				enc.Close()
+				send()
+			}))
+			defer upstream.Close()
+			proxyURL, exchanges := startProxy(t, &Config{Upstream: upstream.URL})
+
+			req, _ := http.NewRequest(http.MethodPost, proxyURL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","stream":true,"stream_options":{"include_usage":true}}`))
+			req.Header.Set("Accept-Encoding", tt.encoding)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if got := resp.Header.Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			body, err := tt.decoder(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			buf := make([]byte, 1024)
+			for !strings.Contains(got.String(), `"Hel"`) {
+				n, err := body.Read(buf)
+				got.Write(buf[:n])
+				if err != nil {
+					t.Fatalf("stream ended before its first chunk: %v", err)
+				}
+			}
+			close(received)
+			rest, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got.Write(rest)
+			if stalled {
+				t.Error("the client got no chunk before the stream ended")
+			}
+			if got.String() != strings.Join(events, "") {
+				t.Errorf("client stream = %q, want the stream sent", got.String())
+			}
+
+			x := exchanges(1)[0]
+			if !x.Streamed {
+				t.Error("streamed = false")
+			}
+			if !jsonEqual(t, x.Response, []byte(want)) {
+				t.Errorf("logged response = %s\nwant %s", x.Response, want)
+			}
+			if x.ResponseBytes != sent {
+				t.Errorf("responseBytes = %d, want the %d bytes sent", x.ResponseBytes, sent)
+			}
+			if x.Usage == nil || x.Usage.InputTokens != 10 || x.Usage.OutputTokens != 5 {
+				t.Errorf("usage = %+v, want 10 input and 5 output tokens", x.Usage)
+			}
+		})
+	}
+}
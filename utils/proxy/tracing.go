@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig exports a span per proxied request over OTLP/HTTP.
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP collector, e.g. "http://localhost:4318".
+	// Tracing is off unless it or the standard OTEL_EXPORTER_OTLP_ENDPOINT
+	// variable is set.
+	Endpoint string `json:"endpoint"`
+	// ServiceName defaults to "llm-proxy".
+	ServiceName string `json:"serviceName"`
+}
+
+// tracer records proxied requests as spans, continuing the trace of the
+// client when it sends a traceparent header.
+type tracer struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func newTracer(cfg TracingConfig) (*tracer, error) {
+	var opts []otlptracehttp.Option
+	switch {
+	case cfg.Endpoint != "":
+		opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	case os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "":
+		return nil, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("OTLP exporter: %w", err)
+	}
+	name := cfg.ServiceName
+	if name == "" {
+		name = "llm-proxy"
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(name))),
+	)
+	return &tracer{
+		provider:   provider,
+		tracer:     provider.Tracer("proxy"),
+		propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+	}, nil
+}
+
+// Start starts the span of a request, as a child of the client's span if
+// any, and passes the new span on to the upstream in the request headers.
+func (t *tracer) Start(r *http.Request) (*http.Request, trace.Span) {
+	if t == nil {
+		return r, nil
+	}
+	ctx := t.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := t.tracer.Start(ctx, r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+	return r.WithContext(ctx), span
+}
+
+// End annotates the span with the outcome of the exchange and ends it.
+// Attributes follow the OpenTelemetry GenAI semantic conventions where they
+// apply.
+func (t *tracer) End(span trace.Span, x *Exchange) {
+	if span == nil {
+		return
+	}
+	if x.Model != "" {
+		span.SetName("chat " + x.Model)
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", x.Method),
+		attribute.String("url.path", x.Path),
+		attribute.Int("http.response.status_code", x.Status),
+		attribute.String("proxy.upstream", x.Upstream),
+		attribute.String("proxy.request_id", x.ID),
+		attribute.Bool("proxy.streamed", x.Streamed),
+		attribute.Float64("proxy.latency_ms", x.LatencyMS),
+		attribute.Int64("proxy.request_bytes", x.RequestBytes),
+		attribute.Int64("proxy.response_bytes", x.ResponseBytes),
+	}
+	for _, a := range []struct{ key, value string }{
+		{"gen_ai.request.model", requestModel(x.Request)},
+		{"gen_ai.response.model", x.Model},
+		{"proxy.session", x.Session},
+		{"proxy.client", x.Client},
+		{"proxy.cache", x.Cache},
+		{"proxy.fault", x.Fault},
+	} {
+		if a.value != "" {
+			attrs = append(attrs, attribute.String(a.key, a.value))
+		}
+	}
+	if x.QueuedMS > 0 {
+		attrs = append(attrs, attribute.Float64("proxy.queued_ms", x.QueuedMS))
+	}
+	if x.Usage != nil {
+		attrs = append(attrs,
+			attribute.Int64("gen_ai.usage.input_tokens", x.Usage.InputTokens),
+			attribute.Int64("gen_ai.usage.output_tokens", x.Usage.OutputTokens),
+			attribute.Int64("gen_ai.usage.cached_input_tokens", x.Usage.CachedInputTokens),
+			attribute.Float64("proxy.cost_usd", x.CostUSD),
+		)
+	}
+	span.SetAttributes(attrs...)
+	for _, retry := range x.Retries {
+		span.AddEvent("retry", trace.WithAttributes(
+			attribute.Int("proxy.attempt", retry.Attempt),
+			attribute.Int("http.response.status_code", retry.Status),
+			attribute.String("error.message", retry.Error),
+			attribute.Float64("proxy.wait_ms", retry.WaitMS),
+		))
+	}
+	switch {
+	case x.Error != "":
+		span.SetStatus(codes.Error, x.Error)
+	case x.Status == 0 || x.Status >= 500:
+		span.SetStatus(codes.Error, http.StatusText(x.Status))
+	}
+	span.End(trace.WithTimestamp(x.End))
+}
+
+// Shutdown flushes the spans not exported yet.
+func (t *tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Exchange is one proxied request/response pair, written to the traffic log
+// as a single JSON line.
+type Exchange struct {
+	ID        string    `json:"id"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	LatencyMS float64   `json:"latencyMs"`
+	// QueuedMS is the time spent waiting for the rate limiter.
+	QueuedMS float64 `json:"queuedMs,omitempty"`
+	Method   string  `json:"method"`
+	Path     string  `json:"path"`
+	// UpstreamPath is the path forwarded to the upstream, without the
+	// route prefix.
+	UpstreamPath string `json:"upstreamPath,omitempty"`
+	Query        string `json:"query,omitempty"`
+	// Upstream is "cassette" or "mock" when the response did not come from
+	// a real upstream.
+	Upstream        string      `json:"upstream"`
+	Status          int         `json:"status"`
+	RequestHeaders  http.Header `json:"requestHeaders"`
+	ResponseHeaders http.Header `json:"responseHeaders"`
+	// Request and Response hold the decoded bodies: parsed JSON when they
+	// are JSON, a string otherwise. Streamed responses are reassembled.
+	Request json.RawMessage `json:"request,omitempty"`
+	// RequestBytes and ResponseBytes are the body sizes on the wire.
+	RequestBytes  int64           `json:"requestBytes"`
+	ResponseBytes int64           `json:"responseBytes"`
+	Response      json.RawMessage `json:"response,omitempty"`
+	Streamed      bool            `json:"streamed,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	// Rewrites are the names of the rewrite rules applied to the request,
+	// whose logged body is the rewritten one.
+	Rewrites []string `json:"rewrites,omitempty"`
+	// Fault describes the fault injected into the exchange, if any.
+	Fault string `json:"fault,omitempty"`
+	// Cache is the response cache result: hit, miss or bypass.
+	Cache string `json:"cache,omitempty"`
+	// Retries are the failed attempts that preceded the response.
+	Retries []*Retry `json:"retries,omitempty"`
+
+	// Client identifies the caller: the X-Proxy-Client header, or the
+	// remote host.
+	Client string `json:"client,omitempty"`
+	// Session groups related exchanges, e.g. those of an eval run: the
+	// session header or path prefix sent by the client, or else its trace.
+	Session string `json:"session,omitempty"`
+	// Trace is the trace ID of the W3C traceparent header.
+	Trace   string  `json:"trace,omitempty"`
+	Model   string  `json:"model,omitempty"`
+	Usage   *Usage  `json:"usage,omitempty"`
+	CostUSD float64 `json:"costUsd,omitempty"`
+	// Priced reports whether the model was found in the pricing table.
+	Priced bool `json:"-"`
+}
+
+// requestIDHeader returns the ID of an exchange to the client.
+const requestIDHeader = "X-Proxy-Request-Id"
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// bodyJSON embeds a decoded body in a log record.
+func bodyJSON(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return body
+	}
+	s, _ := json.Marshal(string(body))
+	return s
+}
+
+// trafficLog writes exchanges as JSON lines to a file, or to stdout.
+type trafficLog struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func openTrafficLog(path string) (*trafficLog, error) {
+	var w io.Writer = os.Stdout
+	if path != "" && path != "-" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("open traffic log: %w", err)
+		}
+		w = f
+	}
+	return &trafficLog{w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (l *trafficLog) Write(x *Exchange) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(x)
+}
+
+func (l *trafficLog) Close() error {
+	if c, ok := l.w.(io.Closer); ok && l.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// readExchanges decodes a JSONL traffic log, calling fn for each exchange.
+func readExchanges(r io.Reader, fn func(*Exchange) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		x := &Exchange{}
+		if err := json.Unmarshal(scanner.Bytes(), x); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(x); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Providers whose wire format the proxy translates OpenAI chat completions
+// to. Requests to other upstreams are forwarded as they are.
+const (
+	providerOpenAI    = "openai"
+	providerAnthropic = "anthropic"
+	providerGemini    = "gemini"
+)
+
+func validProvider(name string) bool {
+	switch name {
+	case "", providerOpenAI, providerAnthropic, providerGemini:
+		return true
+	}
+	return false
+}
+
+// translator lets OpenAI clients talk to other providers: it turns chat
+// completion requests into the wire format of the provider, and the
+// responses, streamed or not, back into chat completions. Other requests
+// pass through.
+type translator struct {
+	provider string
+	next     http.RoundTripper
+}
+
+// newTranslator wraps next with the translation to provider, or returns
+// next as is for OpenAI upstreams.
+func newTranslator(provider string, next http.RoundTripper) http.RoundTripper {
+	if provider == "" || provider == providerOpenAI {
+		return next
+	}
+	return &translator{provider: provider, next: next}
+}
+
+// providerRequest is a chat completion request translated for a provider.
+type providerRequest struct {
+	path   string
+	query  string
+	header http.Header
+	body   any
+}
+
+func (t *translator) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || !strings.HasSuffix(req.URL.Path, "/chat/completions") {
+		return t.next.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var chat chatRequest
+	if err := json.Unmarshal(body, &chat); err != nil {
+		return translationError(req, fmt.Errorf("chat completion request: %w", err)), nil
+	}
+	// The provider path replaces the OpenAI one, keeping any base path of
+	// the upstream, as in /v1/chat/completions -> /v1/messages.
+	base := strings.TrimSuffix(strings.TrimSuffix(req.URL.Path, "/chat/completions"), "/v1")
+	key := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	var pr *providerRequest
+	switch t.provider {
+	case providerAnthropic:
+		pr, err = anthropicRequest(&chat, key)
+	case providerGemini:
+		pr, err = geminiRequest(&chat, key)
+	}
+	if err != nil {
+		return translationError(req, err), nil
+	}
+	if body, err = json.Marshal(pr.body); err != nil {
+		return nil, err
+	}
+
+	out := req.Clone(req.Context())
+	out.URL.Path, out.URL.RawPath, out.URL.RawQuery = base+pr.path, "", pr.query
+	out.Header.Del("Authorization")
+	out.Header.Del("Content-Length")
+	// let the transport negotiate and decode the compression, since the
+	// response is rewritten anyway
+	out.Header.Del("Accept-Encoding")
+	for name, values := range pr.header {
+		if out.Header.Get(name) == "" {
+			out.Header[name] = values
+		}
+	}
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	out.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	resp, err := t.next.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		setBody(resp, "application/json", providerError(resp.StatusCode, data))
+	case isEventStream(resp.Header):
+		stream := &chunkWriter{model: chat.Model, usage: chat.StreamOptions != nil && chat.StreamOptions.IncludeUsage}
+		upstream := resp.Body
+		pr, pw := io.Pipe()
+		stream.w = pw
+		go func() {
+			defer upstream.Close()
+			var err error
+			switch t.provider {
+			case providerAnthropic:
+				err = translateAnthropicStream(upstream, stream)
+			case providerGemini:
+				err = translateGeminiStream(upstream, stream)
+			}
+			pw.CloseWithError(err)
+		}()
+		resp.Body = &pipeBody{PipeReader: pr, upstream: upstream}
+		resp.ContentLength = -1
+		resp.Header.Set("Content-Type", "text/event-stream")
+	default:
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		var completion *chatCompletion
+		switch t.provider {
+		case providerAnthropic:
+			completion, err = anthropicCompletion(data)
+		case providerGemini:
+			completion, err = geminiCompletion(data, chat.Model)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("translate %s response: %w", t.provider, err)
+		}
+		data, _ = json.Marshal(completion)
+		setBody(resp, "application/json", data)
+	}
+	return resp, nil
+}
+
+// pipeBody is the body of a translated stream. Closing it also closes the
+// upstream body, which stops the translation.
+type pipeBody struct {
+	*io.PipeReader
+	upstream io.Closer
+}
+
+func (b *pipeBody) Close() error {
+	b.upstream.Close()
+	return b.PipeReader.Close()
+}
+
+func setBody(resp *http.Response, contentType string, body []byte) {
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.ContentLength = int64(len(body))
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+}
+
+// translationError answers a request that cannot be translated with an
+// OpenAI error.
+func translationError(req *http.Request, err error) *http.Response {
+	resp := &http.Response{
+		Status:     "400 Bad Request",
+		StatusCode: http.StatusBadRequest,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Request:    req,
+	}
+	setBody(resp, "application/json", openAIError("invalid_request_error", err.Error()))
+	return resp
+}
+
+func openAIError(typ, message string) []byte {
+	data, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    typ,
+		},
+	})
+	return data
+}
+
+// providerError turns the error body of a provider into an OpenAI error.
+// Anthropic and Gemini both nest it in an error object, with a type or a
+// status.
+func providerError(status int, body []byte) []byte {
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &e) != nil || e.Error.Message == "" {
+		e.Error.Message = strings.TrimSpace(string(body))
+		if e.Error.Message == "" {
+			e.Error.Message = http.StatusText(status)
+		}
+	}
+	typ := e.Error.Type
+	if typ == "" {
+		typ = strings.ToLower(e.Error.Status)
+	}
+	if typ == "" {
+		typ = "api_error"
+	}
+	return openAIError(typ, e.Error.Message)
+}
+
+// readEvents calls fn with the event type and data of each server-sent
+// event read from r.
+func readEvents(r io.Reader, fn func(event, data string) error) error {
+	br := bufio.NewReader(r)
+	var event string
+	var data []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && line == "" {
+			if err == io.EOF {
+				err = nil
+			}
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				if err := fn(event, strings.Join(data, "\n")); err != nil {
+					return err
+				}
+			}
+			event, data = "", nil
+		case field == "data":
+			data = append(data, value)
+		case field == "event":
+			event = value
+		}
+	}
+}
+
+// chunkWriter writes a translated stream as OpenAI chat completion chunks.
+type chunkWriter struct {
+	w       io.Writer
+	id      string
+	model   string
+	created int64
+	// usage reports whether the client asked for a final usage chunk with
+	// stream_options.include_usage.
+	usage   bool
+	started bool
+}
+
+func (c *chunkWriter) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.w, "data: %s\n\n", data)
+	return err
+}
+
+func (c *chunkWriter) chunk(choices []*chatChoice, usage json.RawMessage) error {
+	if c.id == "" {
+		c.id = "chatcmpl-" + newRequestID()
+	}
+	if c.created == 0 {
+		c.created = time.Now().Unix()
+	}
+	return c.write(&chatCompletion{
+		ID:      c.id,
+		Object:  "chat.completion.chunk",
+		Created: c.created,
+		Model:   c.model,
+		Choices: choices,
+		Usage:   usage,
+	})
+}
+
+// Delta sends a delta of the assistant message, preceded by the role of the
+// message for the first one.
+func (c *chunkWriter) Delta(delta *chatMessage) error {
+	if !c.started {
+		c.started = true
+		if delta.Role == "" {
+			delta.Role = "assistant"
+		}
+	}
+	return c.chunk([]*chatChoice{{Delta: delta}}, nil)
+}
+
+// Finish ends the stream with the finish reason, then the usage if the
+// client asked for it.
+func (c *chunkWriter) Finish(reason string, usage json.RawMessage) error {
+	if err := c.chunk([]*chatChoice{{Delta: &chatMessage{}, FinishReason: &reason}}, nil); err != nil {
+		return err
+	}
+	if c.usage && usage != nil {
+		if err := c.chunk([]*chatChoice{}, usage); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(c.w, "data: [DONE]\n\n")
+	return err
+}
+
+// Error reports an error raised by the provider in the middle of a stream,
+// the way OpenAI does.
+func (c *chunkWriter) Error(data []byte) error {
+	_, err := fmt.Fprintf(c.w, "data: %s\n\n", providerError(http.StatusInternalServerError, data))
+	return err
+}
+
+// openAIUsage is the usage of a chat completion.
+func openAIUsage(prompt, completion, cached int64) json.RawMessage {
+	data, _ := json.Marshal(map[string]any{
+		"prompt_tokens":     prompt,
+		"completion_tokens": completion,
+		"total_tokens":      prompt + completion,
+		"prompt_tokens_details": map[string]any{
+			"cached_tokens": cached,
+		},
+	})
+	return data
+}
+
+// toolArguments returns the arguments of a tool call as a JSON object, as
+// providers want them, rather than the string OpenAI uses.
+func toolArguments(call *toolCall) json.RawMessage {
+	var args map[string]any
+	if json.Unmarshal([]byte(call.Function.Arguments), &args) != nil || args == nil {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(call.Function.Arguments)
+}
+
+// dataURL splits a base64 data URL into its media type and data.
+func dataURL(url string) (mediaType, data string, ok bool) {
+	rest, ok := strings.CutPrefix(url, "data:")
+	if !ok {
+		return "", "", false
+	}
+	meta, data, ok := strings.Cut(rest, ",")
+	mediaType, base64, _ := strings.Cut(meta, ";")
+	if !ok || base64 != "base64" {
+		return "", "", false
+	}
+	return mediaType, data, true
+}
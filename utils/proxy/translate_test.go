@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTranslateRequest(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		provider string
+		chat     string
+		path     string
+		query    string
+		header   http.Header
+		body     string
+	}{
+		{
+			name:     "anthropic text",
+			provider: providerAnthropic,
+			chat:     `{"model":"claude-sonnet-4","temperature":1.5,"stop":"END","messages":[{"role":"system","content":"Be brief."},{"role":"developer","content":"Answer in French."},{"role":"user","content":[{"type":"text","text":"What is this?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBOR"}}]}]}`,
+			path:     "/v1/messages",
+			header:   http.Header{"Anthropic-Version": {anthropicVersion}, "X-Api-Key": {"sk-test"}},
+			body:     `{"model":"claude-sonnet-4","max_tokens":4096,"temperature":1,"stop_sequences":["END"],"system":"Be brief.\n\nAnswer in French.","messages":[{"role":"user","content":[{"type":"text","text":"What is this?"},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"iVBOR"}}]}]}`,
+		},
+		{
+			name:     "anthropic tool calls",
+			provider: providerAnthropic,
+			chat: `{"model":"claude-sonnet-4","max_tokens":100,"stream":true,"tool_choice":{"type":"function","function":{"name":"read"}},
+				"tools":[{"type":"function","function":{"name":"read","description":"Read a file","parameters":{"type":"object","properties":{"path":{"type":"string"}}}}},{"type":"function","function":{"name":"now"}}],
+				"messages":[{"role":"user","content":"Read a and b"},
+					{"role":"assistant","tool_calls":[{"id":"call_a","type":"function","function":{"name":"read","arguments":"{\"path\":\"a\"}"}},{"id":"call_b","type":"function","function":{"name":"read","arguments":"not json"}}]},
+					{"role":"tool","tool_call_id":"call_a","content":"A"},{"role":"tool","tool_call_id":"call_b","content":"B"}]}`,
+			path:   "/v1/messages",
+			header: http.Header{"Anthropic-Version": {anthropicVersion}, "X-Api-Key": {"sk-test"}},
+			body: `{"model":"claude-sonnet-4","max_tokens":100,"stream":true,"tool_choice":{"type":"tool","name":"read"},
+				"tools":[{"name":"read","description":"Read a file","input_schema":{"type":"object","properties":{"path":{"type":"string"}}}},{"name":"now","input_schema":{"type":"object","properties":{}}}],
+				"messages":[{"role":"user","content":[{"type":"text","text":"Read a and b"}]},
+					{"role":"assistant","content":[{"type":"tool_use","id":"call_a","name":"read","input":{"path":"a"}},{"type":"tool_use","id":"call_b","name":"read","input":{}}]},
+					{"role":"user","content":[{"type":"tool_result","tool_use_id":"call_a","content":"A"},{"type":"tool_result","tool_use_id":"call_b","content":"B"}]}]}`,
+		},
+		{
+			name:     "gemini text",
+			provider: providerGemini,
+			chat:     `{"model":"gemini-2.5-pro","max_completion_tokens":50,"stop":["END"],"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":[{"type":"text","text":"What is this?"},{"type":"image_url","image_url":{"url":"https://example.com/cat.png"}}]},{"role":"assistant","content":"A cat."},{"role":"user","content":"Sure?"}]}`,
+			path:     "/v1beta/models/gemini-2.5-pro:generateContent",
+			header:   http.Header{"X-Goog-Api-Key": {"sk-test"}},
+			body:     `{"systemInstruction":{"parts":[{"text":"Be brief."}]},"generationConfig":{"maxOutputTokens":50,"stopSequences":["END"]},"contents":[{"role":"user","parts":[{"text":"What is this?"},{"fileData":{"fileUri":"https://example.com/cat.png"}}]},{"role":"model","parts":[{"text":"A cat."}]},{"role":"user","parts":[{"text":"Sure?"}]}]}`,
+		},
+		{
+			name:     "gemini tool calls",
+			provider: providerGemini,
+			chat: `{"model":"gemini-2.5-pro","stream":true,"tool_choice":"required",
+				"tools":[{"type":"function","function":{"name":"read","parameters":{"type":"object","additionalProperties":false,"required":["path","opts"],"properties":{"path":{"type":["string","null"]},"opts":{"type":"object"},"tags":{"type":"array","items":{"type":"object"}}}}}}],
+				"messages":[{"role":"user","content":"Read a"},
+					{"role":"assistant","tool_calls":[{"id":"call_a","type":"function","function":{"name":"read","arguments":"{\"path\":\"a\"}"}}]},
+					{"role":"tool","tool_call_id":"call_a","content":"A"}]}`,
+			path:   "/v1beta/models/gemini-2.5-pro:streamGenerateContent",
+			query:  "alt=sse",
+			header: http.Header{"X-Goog-Api-Key": {"sk-test"}},
+			body: `{"toolConfig":{"functionCallingConfig":{"mode":"ANY"}},
+				"tools":[{"functionDeclarations":[{"name":"read","parameters":{"type":"object","required":["path"],"properties":{"path":{"type":"string","nullable":true},"tags":{"type":"array"}}}}]}],
+				"contents":[{"role":"user","parts":[{"text":"Read a"}]},
+					{"role":"model","parts":[{"functionCall":{"name":"read","args":{"path":"a"}}}]},
+					{"role":"user","parts":[{"functionResponse":{"name":"read","response":{"content":"A"}}}]}]}`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var chat chatRequest
+			if err := json.Unmarshal([]byte(tt.chat), &chat); err != nil {
+				t.Fatal(err)
+			}
+			var pr *providerRequest
+			var err error
+			switch tt.provider {
+			case providerAnthropic:
+				pr, err = anthropicRequest(&chat, "sk-test")
+			case providerGemini:
+				pr, err = geminiRequest(&chat, "sk-test")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pr.path != tt.path || pr.query != tt.query {
+				t.Errorf("path = %s?%s, want %s?%s", pr.path, pr.query, tt.path, tt.query)
+			}
+			for name := range tt.header {
+				if got, want := pr.header.Get(name), tt.header.Get(name); got != want {
+					t.Errorf("header %s = %q, want %q", name, got, want)
+				}
+			}
+			body, _ := json.Marshal(pr.body)
+			if !jsonEqual(t, body, []byte(tt.body)) {
+				t.Errorf("body = %s\nwant %s", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestGeminiRequestNeedsModel(t *testing.T) {
+	if _, err := geminiRequest(&chatRequest{}, ""); err == nil {
+		t.Error("geminiRequest accepted a request without a model")
+	}
+}
+
+func TestTranslateCompletion(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		provider string
+		response string
+		want     string
+	}{
+		{
+			name:     "anthropic text",
+			provider: providerAnthropic,
+			response: `{"id":"msg_01","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"Hello"},{"type":"text","text":" there"}],"stop_reason":"max_tokens","usage":{"input_tokens":10,"cache_read_input_tokens":90,"cache_creation_input_tokens":0,"output_tokens":5}}`,
+			want:     `{"id":"msg_01","object":"chat.completion","model":"claude-sonnet-4-20250514","choices":[{"index":0,"message":{"role":"assistant","content":"Hello there"},"finish_reason":"length"}],"usage":{"prompt_tokens":100,"completion_tokens":5,"total_tokens":105,"prompt_tokens_details":{"cached_tokens":90}}}`,
+		},
+		{
+			name:     "anthropic tool calls",
+			provider: providerAnthropic,
+			response: `{"id":"msg_02","model":"claude-sonnet-4","content":[{"type":"text","text":"Reading."},{"type":"tool_use","id":"toolu_1","name":"read","input":{"path":"a"}}],"stop_reason":"tool_use","usage":{"input_tokens":10,"output_tokens":5}}`,
+			want:     `{"id":"msg_02","object":"chat.completion","model":"claude-sonnet-4","choices":[{"index":0,"message":{"role":"assistant","content":"Reading.","tool_calls":[{"id":"toolu_1","type":"function","function":{"name":"read","arguments":"{\"path\":\"a\"}"}}]},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15,"prompt_tokens_details":{"cached_tokens":0}}}`,
+		},
+		{
+			name:     "gemini text",
+			provider: providerGemini,
+			response: `{"responseId":"resp-1","modelVersion":"gemini-2.5-pro-001","candidates":[{"content":{"role":"model","parts":[{"text":"thinking...","thought":true},{"text":"Hello"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":5,"thoughtsTokenCount":20,"cachedContentTokenCount":4}}`,
+			want:     `{"id":"resp-1","object":"chat.completion","model":"gemini-2.5-pro-001","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":25,"total_tokens":35,"prompt_tokens_details":{"cached_tokens":4}}}`,
+		},
+		{
+			name:     "gemini tool calls",
+			provider: providerGemini,
+			response: `{"responseId":"resp-2","candidates":[{"content":{"role":"model","parts":[{"functionCall":{"id":"fc_1","name":"read","args":{"path":"a"}}},{"functionCall":{"id":"fc_2","name":"now"}}]},"finishReason":"STOP"}]}`,
+			want:     `{"id":"resp-2","object":"chat.completion","model":"gemini-2.5-pro","choices":[{"index":0,"message":{"role":"assistant","tool_calls":[{"id":"fc_1","type":"function","function":{"name":"read","arguments":"{\"path\":\"a\"}"}},{"id":"fc_2","type":"function","function":{"name":"now","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`,
+		},
+		{
+			name:     "gemini safety",
+			provider: providerGemini,
+			response: `{"responseId":"resp-3","candidates":[{"finishReason":"SAFETY"}]}`,
+			want:     `{"id":"resp-3","object":"chat.completion","model":"gemini-2.5-pro","choices":[{"index":0,"message":{"role":"assistant"},"finish_reason":"content_filter"}]}`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var completion *chatCompletion
+			var err error
+			switch tt.provider {
+			case providerAnthropic:
+				completion, err = anthropicCompletion([]byte(tt.response))
+			case providerGemini:
+				completion, err = geminiCompletion([]byte(tt.response), "gemini-2.5-pro")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			completion.Created = 0
+			got, _ := json.Marshal(completion)
+			if !jsonEqual(t, got, []byte(tt.want)) {
+				t.Errorf("completion = %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// sse joins data lines into a server-sent events stream.
+func sse(events ...string) string {
+	var b strings.Builder
+	for _, e := range events {
+		b.WriteString(e + "\n\n")
+	}
+	return b.String()
+}
+
+func TestTranslateStream(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		provider string
+		stream   string
+		// want is the reassembled completion, without its ID and creation
+		// time.
+		want string
+		// err is the error the stream ends with, if any.
+		err string
+	}{
+		{
+			name:     "anthropic text",
+			provider: providerAnthropic,
+			stream: sse(
+				`event: message_start`+"\n"+`data: {"type":"message_start","message":{"id":"msg_01","model":"claude-sonnet-4","content":[],"usage":{"input_tokens":10,"cache_read_input_tokens":5,"output_tokens":1}}}`,
+				`event: content_block_start`+"\n"+`data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+				`event: content_block_delta`+"\n"+`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}`,
+				`event: ping`+"\n"+`data: {"type":"ping"}`,
+				`event: content_block_delta`+"\n"+`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"lo"}}`,
+				`event: message_delta`+"\n"+`data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":7}}`,
+				`event: message_stop`+"\n"+`data: {"type":"message_stop"}`,
+			),
+			want: `{"object":"chat.completion","model":"claude-sonnet-4","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":15,"completion_tokens":7,"total_tokens":22,"prompt_tokens_details":{"cached_tokens":5}}}`,
+		},
+		{
+			name:     "anthropic tool calls",
+			provider: providerAnthropic,
+			stream: sse(
+				`data: {"type":"message_start","message":{"id":"msg_02","model":"claude-sonnet-4","usage":{"input_tokens":10,"output_tokens":1}}}`,
+				`data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+				`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Reading."}}`,
+				`data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"read","input":{}}}`,
+				`data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"path\":"}}`,
+				`data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"a\"}"}}`,
+				`data: {"type":"content_block_stop","index":1}`,
+				`data: {"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_2","name":"now","input":{}}}`,
+				`data: {"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":""}}`,
+				`data: {"type":"content_block_stop","index":2}`,
+				`data: {"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":30}}`,
+				`data: {"type":"message_stop"}`,
+			),
+			want: `{"object":"chat.completion","model":"claude-sonnet-4","choices":[{"index":0,"message":{"role":"assistant","content":"Reading.","tool_calls":[{"id":"toolu_1","type":"function","function":{"name":"read","arguments":"{\"path\":\"a\"}"}},{"id":"toolu_2","type":"function","function":{"name":"now","arguments":"{}"}}]},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":10,"completion_tokens":30,"total_tokens":40,"prompt_tokens_details":{"cached_tokens":0}}}`,
+		},
+		{
+			name:     "anthropic error",
+			provider: providerAnthropic,
+			stream: sse(
+				`data: {"type":"message_start","message":{"id":"msg_03","model":"claude-sonnet-4","usage":{"input_tokens":10,"output_tokens":1}}}`,
+				`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}`,
+				`event: error`+"\n"+`data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			),
+			want: `{"object":"chat.completion","model":"claude-sonnet-4","choices":[{"index":0,"message":{"role":"assistant","content":"Hel"},"finish_reason":null}]}`,
+			err:  `{"error":{"message":"Overloaded","type":"overloaded_error"}}`,
+		},
+		{
+			name:     "gemini text",
+			provider: providerGemini,
+			stream: sse(
+				`data: {"responseId":"resp-1","modelVersion":"gemini-2.5-pro","candidates":[{"content":{"role":"model","parts":[{"text":"Hel"}]}}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":1}}`,
+				`data: {"responseId":"resp-1","modelVersion":"gemini-2.5-pro","candidates":[{"content":{"role":"model","parts":[{"text":"lo"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":2,"thoughtsTokenCount":3}}`,
+			),
+			want: `{"object":"chat.completion","model":"gemini-2.5-pro","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15,"prompt_tokens_details":{"cached_tokens":0}}}`,
+		},
+		{
+			name:     "gemini tool calls",
+			provider: providerGemini,
+			stream: sse(
+				`data: {"responseId":"resp-2","candidates":[{"content":{"role":"model","parts":[{"functionCall":{"id":"fc_1","name":"read","args":{"path":"a"}}}]}}]}`,
+				`data: {"responseId":"resp-2","candidates":[{"content":{"role":"model","parts":[{"functionCall":{"id":"fc_2","name":"now"}}]},"finishReason":"STOP"}]}`,
+			),
+			want: `{"object":"chat.completion","model":"gemini-2.5-pro","choices":[{"index":0,"message":{"role":"assistant","tool_calls":[{"id":"fc_1","type":"function","function":{"name":"read","arguments":"{\"path\":\"a\"}"}},{"id":"fc_2","type":"function","function":{"name":"now","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`,
+		},
+		{
+			name:     "gemini error",
+			provider: providerGemini,
+			stream: sse(
+				`data: {"responseId":"resp-3","candidates":[{"content":{"role":"model","parts":[{"text":"Hel"}]}}]}`,
+				`data: {"error":{"code":503,"message":"The model is overloaded.","status":"UNAVAILABLE"}}`,
+			),
+			want: `{"object":"chat.completion","model":"gemini-2.5-pro","choices":[{"index":0,"message":{"role":"assistant","content":"Hel"},"finish_reason":null}]}`,
+			err:  `{"error":{"message":"The model is overloaded.","type":"unavailable"}}`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := &chunkWriter{w: &out, model: "gemini-2.5-pro", usage: true}
+			var err error
+			switch tt.provider {
+			case providerAnthropic:
+				err = translateAnthropicStream(strings.NewReader(tt.stream), c)
+			case providerGemini:
+				err = translateGeminiStream(strings.NewReader(tt.stream), c)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := &sseAssembler{}
+			a.Write(out.Bytes())
+			result := a.Result()
+			completion, ok := result.(*chatCompletion)
+			if !ok {
+				t.Fatalf("stream carries no chunks: %s", out.Bytes())
+			}
+			completion.ID, completion.Created = "", 0
+			got, _ := json.Marshal(completion)
+			if !jsonEqual(t, got, []byte(tt.want)) {
+				t.Errorf("completion = %s\nwant %s", got, tt.want)
+			}
+
+			done := strings.HasSuffix(out.String(), "data: [DONE]\n\n")
+			if tt.err == "" {
+				if !done {
+					t.Errorf("stream does not end with [DONE]: %s", out.Bytes())
+				}
+				if len(a.events) > 0 {
+					t.Errorf("unexpected events: %s", a.events)
+				}
+				return
+			}
+			if done {
+				t.Errorf("failed stream ends with [DONE]: %s", out.Bytes())
+			}
+			if len(a.events) != 1 || !jsonEqual(t, a.events[0], []byte(tt.err)) {
+				t.Errorf("events = %s, want the error %s", a.events, tt.err)
+			}
+		})
+	}
+}
+
+// roundTripFunc is an http.RoundTripper standing in for the upstream.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTranslatorRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		provider string
+		path     string
+		request  string
+		status   int
+		response string
+		// upstream is the URL the translated request is sent to.
+		upstream string
+		want     string
+	}{
+		{
+			name:     "anthropic",
+			provider: providerAnthropic,
+			path:     "/claude/v1/chat/completions",
+			request:  `{"model":"claude-sonnet-4","messages":[{"role":"user","content":"hi"}]}`,
+			status:   http.StatusOK,
+			response: `{"id":"msg_01","model":"claude-sonnet-4","content":[{"type":"text","text":"Hello"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`,
+			upstream: "/claude/v1/messages",
+			want:     `{"id":"msg_01","object":"chat.completion","model":"claude-sonnet-4","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2,"prompt_tokens_details":{"cached_tokens":0}}}`,
+		},
+		{
+			name:     "anthropic error",
+			provider: providerAnthropic,
+			path:     "/v1/chat/completions",
+			request:  `{"model":"claude-sonnet-4","messages":[{"role":"user","content":"hi"}]}`,
+			status:   http.StatusTooManyRequests,
+			response: `{"type":"error","error":{"type":"rate_limit_error","message":"Slow down"}}`,
+			upstream: "/v1/messages",
+			want:     `{"error":{"message":"Slow down","type":"rate_limit_error"}}`,
+		},
+		{
+			name:     "gemini error",
+			provider: providerGemini,
+			path:     "/v1/chat/completions",
+			request:  `{"model":"gemini-2.5-pro","messages":[{"role":"user","content":"hi"}]}`,
+			status:   http.StatusBadRequest,
+			response: `{"error":{"code":400,"message":"API key not valid.","status":"INVALID_ARGUMENT"}}`,
+			upstream: "/v1beta/models/gemini-2.5-pro:generateContent",
+			want:     `{"error":{"message":"API key not valid.","type":"invalid_argument"}}`,
+		},
+		{
+			name:     "invalid request",
+			provider: providerGemini,
+			path:     "/v1/chat/completions",
+			request:  `{"messages":[{"role":"user","content":"hi"}]}`,
+			status:   http.StatusBadRequest,
+			want:     `{"error":{"message":"gemini requests need a model","type":"invalid_request_error"}}`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent *http.Request
+			tr := newTranslator(tt.provider, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				sent = req
+				return &http.Response{
+					StatusCode: tt.status,
+					Header:     http.Header{"Content-Type": {"application/json"}},
+					Body:       io.NopCloser(strings.NewReader(tt.response)),
+					Request:    req,
+				}, nil
+			}))
+			req, _ := http.NewRequest(http.MethodPost, "https://upstream.example"+tt.path, strings.NewReader(tt.request))
+			req.Header.Set("Authorization", "Bearer sk-test")
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			var completion map[string]any
+			json.Unmarshal(body, &completion)
+			if _, ok := completion["created"]; ok {
+				delete(completion, "created")
+				body, _ = json.Marshal(completion)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if !jsonEqual(t, body, []byte(tt.want)) {
+				t.Errorf("body = %s\nwant %s", body, tt.want)
+			}
+			if tt.upstream == "" {
+				if sent != nil {
+					t.Errorf("invalid request was sent to %s", sent.URL)
+				}
+				return
+			}
+			if sent.URL.Path != tt.upstream {
+				t.Errorf("upstream path = %s, want %s", sent.URL.Path, tt.upstream)
+			}
+			if sent.Header.Get("Authorization") != "" {
+				t.Error("the OpenAI Authorization header was forwarded")
+			}
+		})
+	}
+}
+
+func TestTranslatorPassesOtherRequests(t *testing.T) {
+	var sent *http.Request
+	tr := newTranslator(providerAnthropic, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent = req
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(`{}`))}, nil
+	}))
+	req, _ := http.NewRequest(http.MethodGet, "https://upstream.example/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer sk-test")
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if sent != req {
+		t.Error("request was not passed through as is")
+	}
+}
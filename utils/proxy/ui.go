@@ -0,0 +1,163 @@
+package main
+
+import (
+	_ "embed"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//go:embed ui/index.html
+var uiPage []byte
+
+// defaultUIMemoryMB bounds the memory taken by the exchanges kept for the
+// web UI, unless configured otherwise.
+const defaultUIMemoryMB = 64
+
+// exchangeOverhead approximates the memory of an exchange besides its
+// bodies: headers, IDs and timings.
+const exchangeOverhead = 2 << 10
+
+// exchangeStore keeps the most recent exchanges for the web UI: those of
+// the traffic log file found at startup, then the ones proxied since. The
+// oldest are dropped once the exchanges take more than max bytes, as agent
+// conversations resend their whole history with each request.
+type exchangeStore struct {
+	max int64
+
+	mu        sync.Mutex
+	exchanges []*Exchange
+	byID      map[string]*Exchange
+	size      int64
+}
+
+func newExchangeStore(logPath string, maxMB int) *exchangeStore {
+	if maxMB <= 0 {
+		maxMB = defaultUIMemoryMB
+	}
+	s := &exchangeStore{max: int64(maxMB) << 20, byID: map[string]*Exchange{}}
+	if logPath == "" || logPath == "-" {
+		return s
+	}
+	f, err := os.Open(logPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("web UI: %v", err)
+		}
+		return s
+	}
+	defer f.Close()
+	if err := readExchanges(f, func(x *Exchange) error {
+		s.Add(x)
+		return nil
+	}); err != nil {
+		log.Printf("web UI: read %s: %v", logPath, err)
+	}
+	return s
+}
+
+func exchangeSize(x *Exchange) int64 {
+	return int64(len(x.Request)+len(x.Response)) + exchangeOverhead
+}
+
+// Add stores x, dropping the oldest exchanges to make room for it. The
+// latest exchange is always kept, whatever its size.
+func (s *exchangeStore) Add(x *Exchange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exchanges = append(s.exchanges, x)
+	s.byID[x.ID] = x
+	s.size += exchangeSize(x)
+	for s.size > s.max && len(s.exchanges) > 1 {
+		old := s.exchanges[0]
+		s.exchanges[0] = nil
+		s.exchanges = s.exchanges[1:]
+		delete(s.byID, old.ID)
+		s.size -= exchangeSize(old)
+	}
+}
+
+// exchangeSummary is a row of the request list.
+type exchangeSummary struct {
+	ID        string  `json:"id"`
+	Start     string  `json:"start"`
+	LatencyMS float64 `json:"latencyMs"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Upstream  string  `json:"upstream"`
+	Status    int     `json:"status"`
+	Streamed  bool    `json:"streamed,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Client    string  `json:"client,omitempty"`
+	Session   string  `json:"session,omitempty"`
+	Trace     string  `json:"trace,omitempty"`
+	Model     string  `json:"model,omitempty"`
+	Usage     *Usage  `json:"usage,omitempty"`
+	CostUSD   float64 `json:"costUsd,omitempty"`
+}
+
+// matchesStatus filters on an exact status code, or a class such as "4xx".
+func matchesStatus(status int, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	if len(filter) == 3 && strings.HasSuffix(filter, "xx") {
+		return strconv.Itoa(status)[:1] == filter[:1]
+	}
+	return strconv.Itoa(status) == filter
+}
+
+// serveList answers with the summaries of the stored exchanges, most recent
+// first, filtered by the model, status, session and trace query parameters.
+func (s *exchangeStore) serveList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	model, status, session, trace := q.Get("model"), q.Get("status"), q.Get("session"), q.Get("trace")
+	s.mu.Lock()
+	list := []*exchangeSummary{}
+	for i := len(s.exchanges) - 1; i >= 0; i-- {
+		x := s.exchanges[i]
+		if model != "" && x.Model != model || session != "" && x.Session != session ||
+			trace != "" && x.Trace != trace || !matchesStatus(x.Status, status) {
+			continue
+		}
+		list = append(list, &exchangeSummary{
+			ID:        x.ID,
+			Start:     x.Start.Format("2006-01-02 15:04:05"),
+			LatencyMS: x.LatencyMS,
+			Method:    x.Method,
+			Path:      x.Path,
+			Upstream:  x.Upstream,
+			Status:    x.Status,
+			Streamed:  x.Streamed,
+			Error:     x.Error,
+			Client:    x.Client,
+			Session:   x.Session,
+			Trace:     x.Trace,
+			Model:     x.Model,
+			Usage:     x.Usage,
+			CostUSD:   x.CostUSD,
+		})
+	}
+	s.mu.Unlock()
+	writeJSON(w, list)
+}
+
+// serveExchange answers with a whole exchange.
+func (s *exchangeStore) serveExchange(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	x := s.byID[r.PathValue("id")]
+	s.mu.Unlock()
+	if x == nil {
+		writeError(w, http.StatusNotFound, "not_found", "no such exchange")
+		return
+	}
+	writeJSON(w, x)
+}
+
+func serveUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(uiPage)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExchangeStoreMemory(t *testing.T) {
+	s := newExchangeStore("", 1)
+	// each exchange takes a third of the store
+	body, _ := json.Marshal(strings.Repeat("a", (1<<20)/3-exchangeOverhead))
+	for i := range 5 {
+		s.Add(&Exchange{ID: fmt.Sprint(i), Request: body})
+	}
+	if len(s.exchanges) != 2 || s.exchanges[0].ID != "3" || s.exchanges[1].ID != "4" {
+		t.Errorf("kept %d exchanges, want the last two", len(s.exchanges))
+	}
+	if s.byID["2"] != nil {
+		t.Error("dropped exchange still served by ID")
+	}
+	if s.size > s.max {
+		t.Errorf("size = %d, over the %d bytes allowed", s.size, s.max)
+	}
+
+	// an exchange larger than the store is kept alone
+	s.Add(&Exchange{ID: "big", Response: json.RawMessage(`"` + strings.Repeat("b", 2<<20) + `"`)})
+	if len(s.exchanges) != 1 || s.exchanges[0].ID != "big" {
+		t.Errorf("kept %d exchanges, want only the latest", len(s.exchanges))
+	}
+}
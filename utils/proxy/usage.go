@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Usage is the token usage reported by the provider for one exchange.
+type Usage struct {
+	InputTokens       int64 `json:"inputTokens"`
+	OutputTokens      int64 `json:"outputTokens"`
+	CachedInputTokens int64 `json:"cachedInputTokens,omitempty"`
+}
+
+func (u *Usage) Add(other Usage) {
+	u.InputTokens += other.InputTokens
+	u.OutputTokens += other.OutputTokens
+	u.CachedInputTokens += other.CachedInputTokens
+}
+
+// parseUsage extracts the model and usage block from a decoded response.
+// Both the OpenAI (prompt_tokens/completion_tokens) and Anthropic
+// (input_tokens/output_tokens) shapes are understood; streamed responses
+// carry the usage of their final chunk once reassembled. Anthropic counts
+// cache reads and writes apart from input_tokens, so they are added back to
+// follow the OpenAI convention, where cached tokens are part of the input.
+func parseUsage(response json.RawMessage) (model string, usage Usage, ok bool) {
+	var body struct {
+		Model string `json:"model"`
+		Usage *struct {
+			PromptTokens        int64 `json:"prompt_tokens"`
+			CompletionTokens    int64 `json:"completion_tokens"`
+			PromptTokensDetails struct {
+				CachedTokens int64 `json:"cached_tokens"`
+			} `json:"prompt_tokens_details"`
+			InputTokens              int64 `json:"input_tokens"`
+			OutputTokens             int64 `json:"output_tokens"`
+			CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+			CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+		} `json:"usage"`
+	}
+	if json.Unmarshal(response, &body) != nil || body.Usage == nil {
+		return body.Model, Usage{}, false
+	}
+	u := body.Usage
+	return body.Model, Usage{
+		InputTokens:       u.PromptTokens + u.InputTokens + u.CacheReadInputTokens + u.CacheCreationInputTokens,
+		OutputTokens:      u.CompletionTokens + u.OutputTokens,
+		CachedInputTokens: u.PromptTokensDetails.CachedTokens + u.CacheReadInputTokens,
+	}, true
+}
+
+// requestModel returns the model named in a decoded request body.
+func requestModel(request json.RawMessage) string {
+	var body struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(request, &body)
+	return body.Model
+}
+
+// Price is the cost of a model in US dollars per million tokens.
+type Price struct {
+	Input       float64 `json:"input"`
+	Output      float64 `json:"output"`
+	CachedInput float64 `json:"cachedInput,omitempty"`
+}
+
+// pricing maps model names to prices. A model without an exact entry uses
+// the entry with the longest matching prefix, so gpt-4o-2024-08-06 is priced
+// as gpt-4o.
+type pricing map[string]Price
+
+func loadPricing(path string) (pricing, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read pricing: %w", err)
+	}
+	var p pricing
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse pricing %s: %w", path, err)
+	}
+	return p, nil
+}
+
+func (p pricing) lookup(model string) (Price, bool) {
+	if price, ok := p[model]; ok {
+		return price, true
+	}
+	var best string
+	for name := range p {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return Price{}, false
+	}
+	return p[best], true
+}
+
+// Cost returns the dollar cost of usage for model, and whether the model is
+// priced at all. Cached input tokens are billed at the cached rate when the
+// table has one.
+func (p pricing) Cost(model string, u Usage) (float64, bool) {
+	price, ok := p.lookup(model)
+	if !ok {
+		return 0, false
+	}
+	input := float64(u.InputTokens)
+	cached := 0.0
+	if price.CachedInput > 0 {
+		cached = float64(u.CachedInputTokens)
+		input = max(input-cached, 0)
+	}
+	return (input*price.Input + cached*price.CachedInput + float64(u.OutputTokens)*price.Output) / 1e6, true
+}
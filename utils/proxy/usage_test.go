@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestParseUsage(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		response string
+		model    string
+		usage    Usage
+	}{
+		{
+			name:     "openai",
+			response: `{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o-2024-08-06","choices":[],"usage":{"prompt_tokens":2006,"completion_tokens":300,"total_tokens":2306,"prompt_tokens_details":{"cached_tokens":1920}}}`,
+			model:    "gpt-4o-2024-08-06",
+			usage:    Usage{InputTokens: 2006, OutputTokens: 300, CachedInputTokens: 1920},
+		},
+		{
+			name:     "anthropic",
+			response: `{"id":"msg_01","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":12,"cache_creation_input_tokens":248,"cache_read_input_tokens":1730,"output_tokens":85,"service_tier":"standard"}}`,
+			model:    "claude-sonnet-4-20250514",
+			usage:    Usage{InputTokens: 12 + 248 + 1730, OutputTokens: 85, CachedInputTokens: 1730},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			model, usage, ok := parseUsage(json.RawMessage(tt.response))
+			if !ok {
+				t.Fatal("no usage found")
+			}
+			if model != tt.model {
+				t.Errorf("model = %q, want %q", model, tt.model)
+			}
+			if usage != tt.usage {
+				t.Errorf("usage = %+v, want %+v", usage, tt.usage)
+			}
+		})
+	}
+}
+
+func TestCostAnthropicCacheReads(t *testing.T) {
+	p := pricing{"claude-sonnet-4": {Input: 3, Output: 15, CachedInput: 0.3}}
+	response := `{"model":"claude-sonnet-4-20250514","usage":{"input_tokens":3,"cache_creation_input_tokens":0,"cache_read_input_tokens":9000,"output_tokens":20}}`
+	model, usage, _ := parseUsage(json.RawMessage(response))
+	cost, ok := p.Cost(model, usage)
+	if !ok {
+		t.Fatalf("%s is not priced", model)
+	}
+	want := (3*3 + 9000*0.3 + 20*15) / 1e6
+	if math.Abs(cost-want) > 1e-12 {
+		t.Errorf("cost = %g, want %g", cost, want)
+	}
+}
+
+func TestCostClampsUncachedInput(t *testing.T) {
+	p := pricing{"m": {Input: 3, Output: 15, CachedInput: 0.3}}
+	// a usage block reporting more cached than input tokens
+	cost, _ := p.Cost("m", Usage{InputTokens: 10, CachedInputTokens: 1000})
+	if cost < 0 {
+		t.Errorf("cost = %g, want it non-negative", cost)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultConfig keeps provider keys out of the clients: they authenticate
+// with proxy tokens, and the proxy adds the credential of the upstream each
+// request is routed to.
+type VaultConfig struct {
+	// Tokens are the proxy tokens clients may use.
+	Tokens []*ProxyToken `json:"tokens"`
+	// TokensFile is a JSON array of tokens, read again when it changes, so
+	// that tokens can be issued and revoked without restarting the proxy.
+	TokensFile string `json:"tokensFile"`
+}
+
+// ProxyToken is a credential given to one client.
+type ProxyToken struct {
+	// Name identifies the client in the traffic log, the stats and the rate
+	// limits.
+	Name string `json:"name"`
+	// SHA256 is the hex digest of the token. Token is the token itself, for
+	// throwaway setups; the digest is preferred, so that the file holds no
+	// usable secret.
+	SHA256 string `json:"sha256,omitempty"`
+	Token  string `json:"token,omitempty"`
+	// Revoked tokens are rejected.
+	Revoked bool `json:"revoked,omitempty"`
+	// RateLimit replaces rateLimit.key for the requests of this token.
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+	// Admin tokens can also read the traffic, stats and metrics of all
+	// clients.
+	Admin bool `json:"admin,omitempty"`
+}
+
+// tokensCheckInterval is how often the tokens file is checked for changes.
+const tokensCheckInterval = time.Second
+
+// authError rejects a request without a valid proxy token.
+type authError struct {
+	reason string
+}
+
+func (e *authError) Error() string {
+	return "proxy token " + e.reason
+}
+
+// vault authenticates clients by their proxy tokens.
+type vault struct {
+	static []*ProxyToken
+	file   string
+
+	mu      sync.Mutex
+	tokens  map[string]*ProxyToken
+	checked time.Time
+	modTime time.Time
+}
+
+// newVault returns the vault of cfg, or nil when no token is configured, in
+// which case clients are not authenticated.
+func newVault(cfg VaultConfig) (*vault, error) {
+	if len(cfg.Tokens) == 0 && cfg.TokensFile == "" {
+		return nil, nil
+	}
+	v := &vault{static: cfg.Tokens, file: cfg.TokensFile}
+	if err := v.load(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// load indexes the configured tokens and those of the tokens file by
+// digest.
+func (v *vault) load() error {
+	tokens := append([]*ProxyToken(nil), v.static...)
+	if v.file != "" {
+		info, err := os.Stat(v.file)
+		if err != nil {
+			return fmt.Errorf("tokens file: %w", err)
+		}
+		data, err := os.ReadFile(v.file)
+		if err != nil {
+			return fmt.Errorf("tokens file: %w", err)
+		}
+		var fromFile []*ProxyToken
+		if err := json.Unmarshal(data, &fromFile); err != nil {
+			return fmt.Errorf("parse tokens file %s: %w", v.file, err)
+		}
+		tokens = append(tokens, fromFile...)
+		v.modTime = info.ModTime()
+	}
+	index := map[string]*ProxyToken{}
+	for i, t := range tokens {
+		digest := strings.ToLower(t.SHA256)
+		if t.Token != "" {
+			digest = tokenDigest(t.Token)
+		}
+		if t.Name == "" || digest == "" {
+			return fmt.Errorf("proxy token %d: name and token or sha256 are required", i)
+		}
+		if prev := index[digest]; prev != nil {
+			return fmt.Errorf("proxy tokens %q and %q are the same", prev.Name, t.Name)
+		}
+		index[digest] = t
+	}
+	v.tokens = index
+	return nil
+}
+
+// reload reads the tokens file again if it changed. On error the previous
+// tokens are kept.
+func (v *vault) reload(now time.Time) {
+	if v.file == "" || now.Sub(v.checked) < tokensCheckInterval {
+		return
+	}
+	v.checked = now
+	info, err := os.Stat(v.file)
+	if err != nil || info.ModTime().Equal(v.modTime) {
+		return
+	}
+	if err := v.load(); err != nil {
+		log.Printf("keeping the previous proxy tokens: %v", err)
+		return
+	}
+	log.Printf("Reloaded proxy tokens from %s", v.file)
+}
+
+// Authenticate returns the token presented by the client of r.
+func (v *vault) Authenticate(r *http.Request) (*ProxyToken, error) {
+	presented, _ := clientKey(r)
+	if presented == "" {
+		return nil, &authError{"missing"}
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.reload(time.Now())
+	t := v.tokens[tokenDigest(presented)]
+	switch {
+	case t == nil:
+		return nil, &authError{"invalid"}
+	case t.Revoked:
+		return nil, &authError{fmt.Sprintf("%q revoked", t.Name)}
+	}
+	return t, nil
+}
+
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// keyHeaders are the headers clients send API keys in, other than
+// Authorization.
+var keyHeaders = []string{"X-Api-Key", "Api-Key", "X-Goog-Api-Key"}
+
+// clientKey returns the API key sent with r, and where it was found: a
+// header name, or "key" for the query parameter Gemini clients use. The
+// password of basic authentication, which browsers send, counts as a key.
+func clientKey(r *http.Request) (key, location string) {
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && key != "" {
+		return key, "Authorization"
+	}
+	if _, key, ok := r.BasicAuth(); ok && key != "" {
+		return key, "Authorization"
+	}
+	for _, h := range keyHeaders {
+		if key := r.Header.Get(h); key != "" {
+			return key, h
+		}
+	}
+	if key := r.URL.Query().Get("key"); key != "" {
+		return key, "key"
+	}
+	return "", ""
+}
+
+// injectCredential replaces the proxy token of r with the upstream
+// credential, where the client put the token so that the provider finds it
+// where it expects it. Keys sent in other places are removed too, so that no
+// copy of the token reaches the upstream. Without a credential, the keys are
+// only removed.
+func injectCredential(r *http.Request, credential string) {
+	_, location := clientKey(r)
+	r.Header.Del("Authorization")
+	for _, h := range keyHeaders {
+		r.Header.Del(h)
+	}
+	q := r.URL.Query()
+	if q.Has("key") {
+		q.Del("key")
+		r.URL.RawQuery = q.Encode()
+	}
+	if credential == "" {
+		return
+	}
+	switch location {
+	case "key":
+		q.Set("key", credential)
+		r.URL.RawQuery = q.Encode()
+	case "", "Authorization":
+		r.Header.Set("Authorization", "Bearer "+credential)
+	default:
+		r.Header.Set(location, credential)
+	}
+}
+
+// resolveCredential reads an upstream credential: env:NAME is taken from the
+// environment, file:PATH from a file such as a mounted secret, and anything
+// else is the credential itself.
+func resolveCredential(ref string) (string, error) {
+	switch {
+	case ref == "":
+		return "", nil
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		v := os.Getenv(name)
+		if v == "" {
+			return "", fmt.Errorf("credential: environment variable %s is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(ref, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(ref, "file:"))
+		if err != nil {
+			return "", fmt.Errorf("credential: %w", err)
+		}
+		v := strings.TrimSpace(string(data))
+		if v == "" {
+			return "", fmt.Errorf("credential: %s is empty", strings.TrimPrefix(ref, "file:"))
+		}
+		return v, nil
+	}
+	return ref, nil
+}
+
+// writeUnauthorized answers a request without a valid proxy token the way
+// providers answer a bad API key.
+func writeUnauthorized(w http.ResponseWriter, err *authError) {
+	writeError(w, http.StatusUnauthorized, "authentication_error", err.Error())
+}
+
+// admin restricts h to admin tokens when clients are authenticated, as it
+// serves the traffic of all of them. Browsers are asked for the token as the
+// password of basic authentication.
+func (v *vault) admin(h http.Handler) http.Handler {
+	if v == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := v.Authenticate(r)
+		if authErr := (*authError)(nil); errors.As(err, &authErr) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="proxy"`)
+			writeUnauthorized(w, authErr)
+			return
+		}
+		if !token.Admin {
+			writeError(w, http.StatusForbidden, "permission_error", fmt.Sprintf("proxy token %q is not an admin token", token.Name))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// tokenCommand issues a proxy token: it prints the token, to hand to the
+// client, and the entry to add to the tokens file, which only holds its
+// digest.
+func tokenCommand(args []string) error {
+	fs := flag.NewFlagSet("proxy token", flag.ContinueOnError)
+	name := fs.String("name", "", "name of the client the token is for")
+	admin := fs.Bool("admin", false, "let the token read the traffic, stats and metrics of all clients")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: proxy token [-admin] -name client")
+		fmt.Fprintln(fs.Output(), "Prints a new proxy token, then its entry for the tokens file on stderr.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	token := "pxy-" + hex.EncodeToString(secret)
+	entry, err := json.Marshal(&ProxyToken{Name: *name, SHA256: tokenDigest(token), Admin: *admin})
+	if err != nil {
+		return fmt.Errorf("encode token entry: %w", err)
+	}
+	fmt.Println(token)
+	fmt.Fprintln(os.Stderr, string(entry))
+	return nil
+}
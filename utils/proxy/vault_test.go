@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInjectCredential(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		header     http.Header
+		query      string
+		credential string
+		wantHeader http.Header
+		wantQuery  string
+	}{
+		{
+			name:       "authorization",
+			header:     http.Header{"Authorization": {"Bearer pxy-token"}},
+			credential: "sk-real",
+			wantHeader: http.Header{"Authorization": {"Bearer sk-real"}},
+		},
+		{
+			name:       "api key header",
+			header:     http.Header{"X-Api-Key": {"pxy-token"}},
+			credential: "sk-real",
+			wantHeader: http.Header{"X-Api-Key": {"sk-real"}},
+		},
+		{
+			name:       "query",
+			query:      "alt=sse&key=pxy-token",
+			credential: "sk-real",
+			wantHeader: http.Header{},
+			wantQuery:  "alt=sse&key=sk-real",
+		},
+		{
+			name: "every location",
+			header: http.Header{
+				"Authorization":  {"Bearer pxy-token"},
+				"X-Api-Key":      {"pxy-token"},
+				"Api-Key":        {"pxy-token"},
+				"X-Goog-Api-Key": {"pxy-token"},
+			},
+			query:      "key=pxy-token",
+			credential: "sk-real",
+			wantHeader: http.Header{"Authorization": {"Bearer sk-real"}},
+		},
+		{
+			name:       "basic authentication",
+			header:     http.Header{"Authorization": {"Basic OnB4eS10b2tlbg=="}},
+			credential: "sk-real",
+			wantHeader: http.Header{"Authorization": {"Bearer sk-real"}},
+		},
+		{
+			name:       "no credential",
+			header:     http.Header{"Authorization": {"Bearer pxy-token"}, "X-Goog-Api-Key": {"pxy-token"}},
+			query:      "key=pxy-token",
+			wantHeader: http.Header{},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?"+tt.query, nil)
+			r.Header = tt.header.Clone()
+			if r.Header == nil {
+				r.Header = http.Header{}
+			}
+			injectCredential(r, tt.credential)
+			if len(r.Header) != len(tt.wantHeader) {
+				t.Errorf("header = %v, want %v", r.Header, tt.wantHeader)
+			}
+			for name := range tt.wantHeader {
+				if got, want := r.Header.Get(name), tt.wantHeader.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if r.URL.RawQuery != tt.wantQuery {
+				t.Errorf("query = %q, want %q", r.URL.RawQuery, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer upstream.Close()
+	proxyURL, _ := startProxy(t, &Config{
+		Upstream:   upstream.URL,
+		Credential: "sk-real",
+		Vault: VaultConfig{Tokens: []*ProxyToken{
+			{Name: "evals", Token: "pxy-evals"},
+			{Name: "ops", Token: "pxy-ops", Admin: true},
+		}},
+	})
+	get := func(path string, auth func(*http.Request)) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, proxyURL+path, nil)
+		auth(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	for _, path := range []string{"/_proxy/stats", "/metrics", "/_proxy/ui", "/_proxy/api/exchanges", "/_proxy/api/exchanges/0123"} {
+		resp := get(path, func(*http.Request) {})
+		if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic") {
+			t.Errorf("%s without a token: status %d, WWW-Authenticate %q, want a 401 asking for basic authentication", path, resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+		}
+		if resp := get(path, bearer("pxy-evals")); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s with a client token: status %d, want 403", path, resp.StatusCode)
+		}
+		want := http.StatusOK
+		if strings.HasSuffix(path, "/0123") {
+			want = http.StatusNotFound
+		}
+		if resp := get(path, bearer("pxy-ops")); resp.StatusCode != want {
+			t.Errorf("%s with an admin token: status %d, want %d", path, resp.StatusCode, want)
+		}
+		if resp := get(path, func(r *http.Request) { r.SetBasicAuth("", "pxy-ops") }); resp.StatusCode != want {
+			t.Errorf("%s with basic authentication: status %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+	if resp := get("/healthz", func(*http.Request) {}); resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz: status %d, want 200 without a token", resp.StatusCode)
+	}
+}